@@ -0,0 +1,361 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/params"
+)
+
+// commands holds all the idm subcommands.
+var commands = []*command{{
+	name: "user show",
+	args: "username",
+	doc:  "show the details of a user",
+	run:  runUserShow,
+}, {
+	name:  "user set",
+	args:  "username",
+	doc:   "create or update a user",
+	flags: userSetFlags,
+	run:   runUserSet,
+}, {
+	name:  "user query",
+	doc:   "list users",
+	flags: userQueryFlags,
+	run:   runUserQuery,
+}, {
+	name: "groups",
+	args: "username",
+	doc:  "list the groups of a user",
+	run:  runGroups,
+}, {
+	name: "extra-info get",
+	args: "username",
+	doc:  "show the extra information stored for a user",
+	run:  runExtraInfoGet,
+}, {
+	name: "extra-info set",
+	args: "username json-object",
+	doc:  "set items of extra information for a user",
+	run:  runExtraInfoSet,
+}, {
+	name: "extra-info item",
+	args: "username item [json-value]",
+	doc:  "show or set a single item of extra information",
+	run:  runExtraInfoItem,
+}, {
+	name: "token",
+	args: "username",
+	doc:  "mint a token (macaroon) that declares a user",
+	run:  runToken,
+}, {
+	name: "verify",
+	args: "[file]",
+	doc:  "verify a token read from a file or standard input",
+	run:  runVerify,
+}, {
+	name:  "agent create",
+	args:  "username",
+	doc:   "create an agent and add it to an agent file",
+	flags: agentCreateFlags,
+	run:   runAgentCreate,
+}}
+
+func runUserShow(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	u, err := e.client.UserContext(e.ctx, &params.UserRequest{
+		Username: params.Username(args[0]),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	keys := make([]string, len(u.PublicKeys))
+	for i, k := range u.PublicKeys {
+		keys[i] = k.String()
+	}
+	return e.write(u, [][]string{
+		{"username", string(u.Username)},
+		{"external-id", u.ExternalID},
+		{"owner", string(u.Owner)},
+		{"fullname", u.FullName},
+		{"email", u.Email},
+		{"groups", strings.Join(u.IDPGroups, ",")},
+		{"public-keys", strings.Join(keys, ",")},
+	})
+}
+
+// userSetParams holds the flags for the "user set" command.
+var userSetParams struct {
+	externalID string
+	owner      string
+	fullName   string
+	email      string
+	groups     string
+}
+
+func userSetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&userSetParams.externalID, "external-id", "", "external ID of the user")
+	fs.StringVar(&userSetParams.owner, "owner", "", "owner of the user, for agents")
+	fs.StringVar(&userSetParams.fullName, "fullname", "", "full name of the user")
+	fs.StringVar(&userSetParams.email, "email", "", "email address of the user")
+	fs.StringVar(&userSetParams.groups, "groups", "", "comma-separated groups of a new user")
+}
+
+func runUserSet(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	p := userSetParams
+	u := params.User{
+		ExternalID: p.externalID,
+		Owner:      params.Username(p.owner),
+		FullName:   p.fullName,
+		Email:      p.email,
+	}
+	if p.groups != "" {
+		u.IDPGroups = strings.Split(p.groups, ",")
+	}
+	err := e.client.SetUserContext(e.ctx, &params.SetUserRequest{
+		Username: params.Username(args[0]),
+		User:     u,
+	})
+	return errgo.Mask(err)
+}
+
+// userQueryParams holds the flags for the "user query" command.
+var userQueryParams struct {
+	externalID string
+}
+
+func userQueryFlags(fs *flag.FlagSet) {
+	fs.StringVar(&userQueryParams.externalID, "external-id", "", "only list the user with this external ID")
+}
+
+func runUserQuery(e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	users, err := e.client.QueryUsersContext(e.ctx, &params.QueryUsersRequest{
+		ExternalID: userQueryParams.externalID,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return e.write(users, column(users))
+}
+
+func runGroups(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	groups, err := e.client.UserGroupsContext(e.ctx, &params.UserGroupsRequest{
+		Username: params.Username(args[0]),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return e.write(groups, column(groups))
+}
+
+func runExtraInfoGet(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	info, err := e.client.UserExtraInfoContext(e.ctx, &params.UserExtraInfoRequest{
+		Username: params.Username(args[0]),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	rows, err := mapRows(info)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return e.write(info, rows)
+}
+
+func runExtraInfoSet(e *env, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal([]byte(args[1]), &info); err != nil {
+		return errgo.Notef(err, "invalid extra-info object")
+	}
+	err := e.client.SetUserExtraInfoContext(e.ctx, &params.SetUserExtraInfoRequest{
+		Username:  params.Username(args[0]),
+		ExtraInfo: info,
+	})
+	return errgo.Mask(err)
+}
+
+func runExtraInfoItem(e *env, args []string) error {
+	switch len(args) {
+	case 2:
+		v, err := e.client.UserExtraInfoItemContext(e.ctx, &params.UserExtraInfoItemRequest{
+			Username: params.Username(args[0]),
+			Item:     args[1],
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		s, err := jsonString(v)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return e.write(v, [][]string{{s}})
+	case 3:
+		var v interface{}
+		if err := json.Unmarshal([]byte(args[2]), &v); err != nil {
+			return errgo.Notef(err, "invalid extra-info value")
+		}
+		err := e.client.SetUserExtraInfoItemContext(e.ctx, &params.SetUserExtraInfoItemRequest{
+			Username: params.Username(args[0]),
+			Item:     args[1],
+			Data:     v,
+		})
+		return errgo.Mask(err)
+	}
+	return errUsage
+}
+
+func runToken(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	m, err := e.client.UserTokenContext(e.ctx, &params.UserTokenRequest{
+		Username: params.Username(args[0]),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// The token is always written as JSON so that
+	// it can be passed to the verify command.
+	return errgo.Mask(writeJSON(e.stdout, macaroon.Slice{m}))
+}
+
+func runVerify(e *env, args []string) error {
+	var data []byte
+	var err error
+	switch len(args) {
+	case 0:
+		data, err = ioutil.ReadAll(e.stdin)
+	case 1:
+		data, err = ioutil.ReadFile(args[0])
+	default:
+		return errUsage
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot read token")
+	}
+	var ms macaroon.Slice
+	if err := json.Unmarshal(data, &ms); err != nil {
+		// Allow a single macaroon as well as a slice.
+		var m macaroon.Macaroon
+		if err1 := json.Unmarshal(data, &m); err1 != nil {
+			return errgo.Notef(err, "cannot unmarshal token")
+		}
+		ms = macaroon.Slice{&m}
+	}
+	attrs, err := e.client.VerifyTokenContext(e.ctx, &params.VerifyTokenRequest{
+		Macaroons: ms,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	rows := make([][]string, 0, len(attrs))
+	for _, k := range sortedKeys(attrs) {
+		rows = append(rows, []string{k, attrs[k]})
+	}
+	return e.write(attrs, rows)
+}
+
+// agentCreateParams holds the flags for the "agent create" command.
+var agentCreateParams struct {
+	owner    string
+	fullName string
+	file     string
+}
+
+func agentCreateFlags(fs *flag.FlagSet) {
+	fs.StringVar(&agentCreateParams.owner, "owner", "", "owner of the agent (default: the part of the username after the first @)")
+	fs.StringVar(&agentCreateParams.fullName, "fullname", "", "description of the agent")
+	fs.StringVar(&agentCreateParams.file, "f", defaultAgentFilePath(), "agent file to add the agent to")
+}
+
+// runAgentCreate creates an agent, adding it to the agent file. If the
+// agent file already exists, its key is used for the new agent;
+// otherwise a new key is generated and a new file created. The agent
+// file is written before the agent is registered so that the private
+// key is never lost once the identity server accepts its public key.
+func runAgentCreate(e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	p := agentCreateParams
+	username := args[0]
+	owner := p.owner
+	if owner == "" {
+		i := strings.Index(username, "@")
+		if i == -1 {
+			return errgo.Newf("cannot determine owner of %q; use -owner", username)
+		}
+		owner = username[i+1:]
+	}
+	f, err := idmclient.ReadAgentFile(p.file)
+	if err != nil {
+		if !os.IsNotExist(errgo.Cause(err)) {
+			return errgo.Mask(err)
+		}
+		f = new(idmclient.AgentFile)
+	}
+	if f.Key == nil {
+		f.Key, err = bakery.GenerateKey()
+		if err != nil {
+			return errgo.Notef(err, "cannot generate key")
+		}
+	}
+	oldAgents := append([]idmclient.AgentFileEntry(nil), f.Agents...)
+	entry := idmclient.AgentFileEntry{
+		URL:      e.url,
+		Username: params.Username(username),
+	}
+	f.SetAgent(entry)
+	if err := os.MkdirAll(filepath.Dir(p.file), 0700); err != nil {
+		return errgo.Notef(err, "cannot create agent file directory")
+	}
+	if err := idmclient.WriteAgentFile(p.file, f); err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = e.client.CreateAgentContext(e.ctx, idmclient.CreateAgentParams{
+		Username: params.Username(username),
+		Owner:    params.Username(owner),
+		FullName: p.fullName,
+		Key:      f.Key,
+	})
+	if err != nil {
+		// Remove the entry for the agent again, keeping the
+		// key so that it is reused next time.
+		f.Agents = oldAgents
+		if err1 := idmclient.WriteAgentFile(p.file, f); err1 != nil {
+			return errgo.Notef(err, "cannot remove agent from agent file (%v)", err1)
+		}
+		return errgo.Mask(err)
+	}
+	return e.write(entry, [][]string{{entry.URL, string(entry.Username)}})
+}
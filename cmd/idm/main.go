@@ -0,0 +1,361 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The idm command provides command-line access to an identity server.
+//
+// Usage:
+//
+//	idm [global flags] command [flags] [args]
+//
+// Run "idm help" for a list of commands. The identity server URL is
+// taken, in order of preference, from the -url flag, the IDM_URL
+// environment variable, the "url" field of the configuration file and
+// finally defaults to the production server. The names "production" and
+// "staging" may be used in place of a URL.
+//
+// The configuration file, by default $HOME/.config/idm/config.json,
+// holds a JSON object with the following optional fields:
+//
+//	url             the identity server URL or preset name
+//	admin-username  the username used for admin basic authentication
+//
+// Admin basic authentication is used when an admin username is given
+// by the -admin-username flag, the IDM_ADMIN_USERNAME environment
+// variable or the configuration file. The password is taken from the
+// IDM_ADMIN_PASSWORD environment variable. Otherwise, if -agent-file,
+// or -agent-username and -agent-key, are given, the command logs in as
+// an agent; failing that it logs in interactively. An agent file, as
+// created by "idm agent create", must hold an agent for the identity
+// server being used.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+
+	"github.com/juju/identity/idmclient"
+)
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// presets holds the identity server URLs that may
+// be referred to by name.
+var presets = map[string]string{
+	"production": idmclient.Production,
+	"staging":    idmclient.Staging,
+}
+
+// config holds the contents of the configuration file.
+type config struct {
+	URL           string `json:"url"`
+	AdminUsername string `json:"admin-username"`
+}
+
+// env holds the environment in which a command runs.
+type env struct {
+	ctx    context.Context
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// client holds the identity client used by the command,
+	// and url holds the URL of the identity server.
+	client *idmclient.Client
+	url    string
+
+	// format holds the output format, "json" or "table".
+	format string
+}
+
+// command represents an idm subcommand.
+type command struct {
+	// name holds the name of the command, and args
+	// describes its arguments.
+	name string
+	args string
+
+	// doc holds a one-line description of the command.
+	doc string
+
+	// flags, if non-nil, is called to add
+	// the command's flags to the flag set.
+	flags func(fs *flag.FlagSet)
+
+	// run runs the command with the given arguments.
+	run func(e *env, args []string) error
+}
+
+// run runs the idm command with the given arguments, returning
+// its exit status.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("idm", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		configPath    = fs.String("config", defaultConfigPath(), "path to the configuration file")
+		url           = fs.String("url", "", "identity server URL or preset name (production, staging)")
+		adminUsername = fs.String("admin-username", "", "username for admin basic authentication")
+		agentUsername = fs.String("agent-username", "", "username to log in with as an agent")
+		agentKey      = fs.String("agent-key", "", "path to a file holding the agent's key pair")
+		agentFile     = fs.String("agent-file", "", "path to an agent file to log in with")
+		format        = fs.String("format", "json", "output format (json or table)")
+	)
+	fs.Usage = func() {
+		usage(stderr, fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		usage(stderr, fs)
+		return 2
+	}
+	if *format != "json" && *format != "table" {
+		fmt.Fprintf(stderr, "idm: unknown output format %q\n", *format)
+		return 2
+	}
+	cmdName, args := fs.Arg(0), fs.Args()[1:]
+	if cmdName == "help" {
+		usage(stdout, fs)
+		return 0
+	}
+	cmd, args, err := lookupCommand(cmdName, args)
+	if err != nil {
+		fmt.Fprintf(stderr, "idm: %v\n", err)
+		return 2
+	}
+	cmdFlags := flag.NewFlagSet("idm "+cmd.name, flag.ContinueOnError)
+	cmdFlags.SetOutput(stderr)
+	if cmd.flags != nil {
+		cmd.flags(cmdFlags)
+	}
+	cmdFlags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: idm %s [flags] %s\n", cmd.name, cmd.args)
+		cmdFlags.PrintDefaults()
+	}
+	if err := cmdFlags.Parse(args); err != nil {
+		return 2
+	}
+	cfg, err := readConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "idm: %v\n", err)
+		return 1
+	}
+	serverURL := resolveURL(firstNonEmpty(*url, os.Getenv("IDM_URL"), cfg.URL))
+	client, err := newClient(clientParams{
+		url:           serverURL,
+		adminUsername: firstNonEmpty(*adminUsername, os.Getenv("IDM_ADMIN_USERNAME"), cfg.AdminUsername),
+		adminPassword: os.Getenv("IDM_ADMIN_PASSWORD"),
+		agentUsername: *agentUsername,
+		agentKeyPath:  *agentKey,
+		agentFile:     *agentFile,
+		stdin:         stdin,
+		stderr:        stderr,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "idm: %v\n", err)
+		return 1
+	}
+	e := &env{
+		ctx:    ctx,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		client: client,
+		url:    serverURL,
+		format: *format,
+	}
+	if err := cmd.run(e, cmdFlags.Args()); err != nil {
+		if errgo.Cause(err) == errUsage {
+			cmdFlags.Usage()
+			return 2
+		}
+		fmt.Fprintf(stderr, "idm: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// errUsage is returned by a command when
+// it has been called with invalid arguments.
+var errUsage = errgo.New("invalid usage")
+
+// lookupCommand returns the command with the given name, which may be
+// the first word of a two-word command name, and the remaining
+// arguments.
+func lookupCommand(name string, args []string) (*command, []string, error) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, args, nil
+		}
+	}
+	if len(args) > 0 {
+		for _, cmd := range commands {
+			if cmd.name == name+" "+args[0] {
+				return cmd, args[1:], nil
+			}
+		}
+	}
+	return nil, nil, errgo.Newf("unknown command %q", name)
+}
+
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "usage: idm [flags] command [flags] [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-20s %s\n", cmd.name, cmd.doc)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// clientParams holds the parameters for newClient.
+type clientParams struct {
+	url           string
+	adminUsername string
+	adminPassword string
+	agentUsername string
+	agentKeyPath  string
+	agentFile     string
+
+	// stdin and stderr are used to prompt for
+	// credentials when logging in interactively.
+	stdin  io.Reader
+	stderr io.Writer
+}
+
+// newClient returns an identity client that authenticates
+// as specified by p.
+func newClient(p clientParams) (*idmclient.Client, error) {
+	bclient := httpbakery.NewClient()
+	var visitor *idmclient.Visitor
+	switch {
+	case p.adminUsername != "":
+	case p.agentFile != "":
+		var err error
+		bclient, err = idmclient.NewAgentClient(p.agentFile, p.url)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	case p.agentUsername != "" || p.agentKeyPath != "":
+		if p.agentUsername == "" || p.agentKeyPath == "" {
+			return nil, errgo.New("both -agent-username and -agent-key must be specified")
+		}
+		key, err := readKey(p.agentKeyPath)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		bclient.Key = key
+		visitor = &idmclient.Visitor{
+			Methods: []idmclient.LoginMethod{
+				idmclient.AgentLoginMethod(bclient.Client, p.agentUsername, key),
+			},
+		}
+	default:
+		visitor = &idmclient.Visitor{
+			Methods: []idmclient.LoginMethod{
+				idmclient.FormLoginMethod(bclient.Client, idmclient.NewTerminalFormFiller(p.stdin, p.stderr)),
+				idmclient.InteractiveLoginMethod(idmclient.InteractiveParams{
+					Out: p.stderr,
+				}),
+			},
+		}
+	}
+	return idmclient.New(idmclient.NewParams{
+		BaseURL:      p.url,
+		Client:       bclient,
+		AuthUsername: p.adminUsername,
+		AuthPassword: p.adminPassword,
+		Visitor:      visitor,
+	}), nil
+}
+
+// resolveURL returns the identity server URL referred to by the given
+// URL or preset name. If url is empty, the production server is used.
+func resolveURL(url string) string {
+	if url == "" {
+		return idmclient.Production
+	}
+	if preset, ok := presets[url]; ok {
+		return preset
+	}
+	return url
+}
+
+// readKey reads a JSON-encoded key pair from the given file, which
+// must not be world-readable.
+func readKey(path string) (*bakery.KeyPair, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read agent key")
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read agent key")
+	}
+	if err := idmclient.CheckKeyFileMode(info.Mode()); err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot read agent key %q", path), errgo.Is(idmclient.ErrAgentFileInsecure))
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read agent key")
+	}
+	var key bakery.KeyPair
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal agent key")
+	}
+	return &key, nil
+}
+
+// defaultConfigPath returns the path of the
+// default configuration file.
+func defaultConfigPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "idm", "config.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "idm", "config.json")
+}
+
+// defaultAgentFilePath returns the path of the
+// default agent file.
+func defaultAgentFilePath() string {
+	return filepath.Join(filepath.Dir(defaultConfigPath()), "agent.json")
+}
+
+// readConfig reads the configuration file at the given path. It is
+// not an error for the file not to exist.
+func readConfig(path string) (*config, error) {
+	var cfg config
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read configuration")
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errgo.Notef(err, "cannot parse configuration file %q", path)
+	}
+	return &cfg, nil
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/idmtest"
+)
+
+type mainSuite struct {
+	srv        *idmtest.Server
+	configPath string
+	savedEnv   map[string]string
+}
+
+var _ = gc.Suite(&mainSuite{})
+
+var testEnvVars = []string{"IDM_URL", "IDM_ADMIN_USERNAME", "IDM_ADMIN_PASSWORD"}
+
+func (s *mainSuite) SetUpTest(c *gc.C) {
+	s.savedEnv = make(map[string]string)
+	for _, name := range testEnvVars {
+		s.savedEnv[name] = os.Getenv(name)
+		os.Unsetenv(name)
+	}
+	os.Setenv("IDM_ADMIN_PASSWORD", "password")
+	s.srv = idmtest.NewServer()
+	s.srv.SetAdminCredentials("admin", "password")
+	s.srv.AddUser("bob", "beatles", "bass")
+	s.configPath = filepath.Join(c.MkDir(), "config.json")
+}
+
+func (s *mainSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+	for name, val := range s.savedEnv {
+		os.Setenv(name, val)
+	}
+}
+
+// run runs the idm command as the admin user with the given arguments
+// and standard input, and returns its exit status and output.
+func (s *mainSuite) run(stdin string, args ...string) (code int, stdout, stderr string) {
+	args = append([]string{
+		"-config", s.configPath,
+		"-url", s.srv.URL.String(),
+		"-admin-username", "admin",
+	}, args...)
+	var outBuf, errBuf bytes.Buffer
+	code = run(context.Background(), args, strings.NewReader(stdin), &outBuf, &errBuf)
+	return code, outBuf.String(), errBuf.String()
+}
+
+func (s *mainSuite) TestUserSetAndShow(c *gc.C) {
+	code, _, stderr := s.run("", "user", "set", "-external-id", "http://example.com/alice", "-fullname", "Alice", "-groups", "stones", "alice")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+
+	code, stdout, stderr := s.run("", "-format", "table", "user", "show", "alice")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Matches, `(?s)username +alice\nexternal-id +http://example.com/alice\n.*fullname +Alice\n.*groups +stones\n.*`)
+
+	code, stdout, _ = s.run("", "user", "show", "alice")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Matches, `(?s)\{.*"username": "alice",.*"fullname": "Alice",.*\}\n`)
+
+	code, stdout, _ = s.run("", "-format", "table", "user", "query")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Equals, "alice\nbob\n")
+}
+
+func (s *mainSuite) TestGroups(c *gc.C) {
+	code, stdout, stderr := s.run("", "groups", "bob")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Equals, "[\n\t\"beatles\",\n\t\"bass\"\n]\n")
+
+	code, stdout, _ = s.run("", "-format", "table", "groups", "bob")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Equals, "beatles\nbass\n")
+}
+
+func (s *mainSuite) TestExtraInfo(c *gc.C) {
+	code, _, stderr := s.run("", "extra-info", "set", "bob", `{"color": "blue", "size": 3}`)
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	code, _, stderr = s.run("", "extra-info", "item", "bob", "shape", `"round"`)
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+
+	code, stdout, _ := s.run("", "-format", "table", "extra-info", "get", "bob")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Equals, "color  \"blue\"\nshape  \"round\"\nsize   3\n")
+
+	code, stdout, _ = s.run("", "extra-info", "item", "bob", "color")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Equals, "\"blue\"\n")
+}
+
+func (s *mainSuite) TestTokenAndVerify(c *gc.C) {
+	code, token, stderr := s.run("", "token", "bob")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+
+	code, stdout, stderr := s.run(token, "-format", "table", "verify")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Equals, "username  bob\n")
+
+	path := filepath.Join(c.MkDir(), "token")
+	err := ioutil.WriteFile(path, []byte(token), 0600)
+	c.Assert(err, gc.IsNil)
+	code, stdout, _ = s.run("", "verify", path)
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Equals, "{\n\t\"username\": \"bob\"\n}\n")
+}
+
+func (s *mainSuite) TestConfigFile(c *gc.C) {
+	err := ioutil.WriteFile(s.configPath, []byte(`{"url": "`+s.srv.URL.String()+`", "admin-username": "admin"}`), 0600)
+	c.Assert(err, gc.IsNil)
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-config", s.configPath, "-format", "table", "groups", "bob"}, nil, &stdout, &stderr)
+	c.Assert(stderr.String(), gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout.String(), gc.Equals, "beatles\nbass\n")
+}
+
+func (s *mainSuite) TestErrors(c *gc.C) {
+	code, _, stderr := s.run("", "frobnicate")
+	c.Assert(code, gc.Equals, 2)
+	c.Assert(stderr, gc.Equals, "idm: unknown command \"frobnicate\"\n")
+
+	code, _, stderr = s.run("", "groups")
+	c.Assert(code, gc.Equals, 2)
+	c.Assert(stderr, gc.Matches, "usage: idm groups \\[flags\\] username\n")
+
+	code, _, stderr = s.run("", "groups", "nobody")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Matches, `idm: .*user "nobody" not found\n`)
+
+	code, _, stderr = s.run("", "-format", "xml", "groups", "bob")
+	c.Assert(code, gc.Equals, 2)
+	c.Assert(stderr, gc.Equals, "idm: unknown output format \"xml\"\n")
+}
+
+func (s *mainSuite) TestHelp(c *gc.C) {
+	code, stdout, _ := s.run("", "help")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Matches, `(?s)usage: idm .*user show +show the details of a user\n.*`)
+}
+
+func (s *mainSuite) TestAgentCreate(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "agents", "agent.json")
+	code, stdout, stderr := s.run("", "-format", "table", "agent", "create", "-f", path, "myagent@bob")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(stdout, gc.Equals, s.srv.URL.String()+"  myagent@bob\n")
+	f, err := idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.Agents, jc.DeepEquals, []idmclient.AgentFileEntry{{
+		URL:      s.srv.URL.String(),
+		Username: "myagent@bob",
+	}})
+
+	// Creating another agent for the same server reuses the
+	// key and replaces the entry.
+	code, _, stderr = s.run("", "agent", "create", "-f", path, "-owner", "bob", "other@bob")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	f1, err := idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f1.Key, jc.DeepEquals, f.Key)
+	c.Assert(f1.Agents, jc.DeepEquals, []idmclient.AgentFileEntry{{
+		URL:      s.srv.URL.String(),
+		Username: "other@bob",
+	}})
+
+	// The agent file can be used to log in.
+	var outBuf, errBuf bytes.Buffer
+	code = run(context.Background(), []string{
+		"-config", s.configPath,
+		"-url", s.srv.URL.String(),
+		"-agent-file", path,
+		"-format", "table",
+		"user", "show", "other@bob",
+	}, nil, &outBuf, &errBuf)
+	c.Assert(errBuf.String(), gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	c.Assert(outBuf.String(), gc.Matches, `(?s)username +other@bob\n.*owner +bob\n.*`)
+}
+
+func (s *mainSuite) TestAgentCreateFailure(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "agent.json")
+	code, _, stderr := s.run("", "agent", "create", "-f", path, "-owner", "alice", "myagent@bob")
+	c.Assert(stderr, gc.Matches, `idm: cannot create agent: .*suffix must be "@alice".*\n`)
+	c.Assert(code, gc.Equals, 1)
+
+	// The key is kept in the agent file but the agent is not added.
+	f, err := idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.Key, gc.NotNil)
+	c.Assert(f.Agents, gc.HasLen, 0)
+
+	// A later attempt uses the same key.
+	code, _, stderr = s.run("", "agent", "create", "-f", path, "myagent@bob")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	f1, err := idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f1.Key, jc.DeepEquals, f.Key)
+	c.Assert(s.srv.UserPublicKeys("myagent@bob"), jc.DeepEquals, []*bakery.PublicKey{&f.Key.Public})
+}
+
+func (s *mainSuite) TestInsecureAgentFile(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "agent.json")
+	code, _, stderr := s.run("", "agent", "create", "-f", path, "myagent@bob")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+	err := os.Chmod(path, 0644)
+	c.Assert(err, gc.IsNil)
+
+	var outBuf, errBuf bytes.Buffer
+	code = run(context.Background(), []string{
+		"-config", s.configPath,
+		"-url", s.srv.URL.String(),
+		"-agent-file", path,
+		"groups", "myagent@bob",
+	}, nil, &outBuf, &errBuf)
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(errBuf.String(), gc.Matches, `idm: cannot read agent file ".*": permissions -rw-r--r-- are too open\n`)
+}
+
+func (s *mainSuite) TestAgentKey(c *gc.C) {
+	data, err := json.Marshal(s.srv.UserPublicKey("bob"))
+	c.Assert(err, gc.IsNil)
+	path := filepath.Join(c.MkDir(), "key.json")
+	err = ioutil.WriteFile(path, data, 0600)
+	c.Assert(err, gc.IsNil)
+	args := []string{
+		"-config", s.configPath,
+		"-url", s.srv.URL.String(),
+		"-agent-username", "bob",
+		"-agent-key", path,
+		"groups", "bob",
+	}
+	var outBuf, errBuf bytes.Buffer
+	code := run(context.Background(), args, nil, &outBuf, &errBuf)
+	c.Assert(errBuf.String(), gc.Equals, "")
+	c.Assert(code, gc.Equals, 0)
+
+	// A world-readable key file is refused.
+	err = os.Chmod(path, 0644)
+	c.Assert(err, gc.IsNil)
+	outBuf.Reset()
+	errBuf.Reset()
+	code = run(context.Background(), args, nil, &outBuf, &errBuf)
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(errBuf.String(), gc.Matches, `idm: cannot read agent key ".*": permissions -rw-r--r-- are too open\n`)
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/errgo.v1"
+)
+
+// write writes a command's result in the requested format. The value v
+// is used for JSON output and rows is used for table output.
+func (e *env) write(v interface{}, rows [][]string) error {
+	if e.format == "json" {
+		return errgo.Mask(writeJSON(e.stdout, v))
+	}
+	tw := tabwriter.NewWriter(e.stdout, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return errgo.Mask(tw.Flush())
+}
+
+// writeJSON writes v to w as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal result")
+	}
+	data = append(data, '\n')
+	_, err = w.Write(data)
+	return errgo.Mask(err)
+}
+
+// column returns a table with a single column
+// holding the given values.
+func column(values []string) [][]string {
+	rows := make([][]string, len(values))
+	for i, v := range values {
+		rows[i] = []string{v}
+	}
+	return rows
+}
+
+// mapRows returns a two-column table holding the keys of m
+// in sorted order and their values encoded as JSON.
+func mapRows(m map[string]interface{}) ([][]string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rows := make([][]string, len(keys))
+	for i, k := range keys {
+		s, err := jsonString(m[k])
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rows[i] = []string{k, s}
+	}
+	return rows, nil
+}
+
+// jsonString returns the compact JSON encoding of v.
+func jsonString(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot marshal value")
+	}
+	return string(data), nil
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
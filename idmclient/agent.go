@@ -0,0 +1,274 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+
+	"github.com/juju/identity/params"
+)
+
+var (
+	// ErrAgentLoginNotSupported is the cause of the error returned
+	// when the identity server does not offer agent login.
+	ErrAgentLoginNotSupported = errgo.New("agent login not supported")
+
+	// ErrAgentLoginRejected is the cause of the error returned
+	// when the identity server rejects an agent login attempt.
+	ErrAgentLoginRejected = errgo.New("agent login rejected")
+)
+
+// SetUpAgentLogin configures c to log in to the identity server as the
+// agent with the given username and key pair. The key must have been
+// registered as one of the agent's public keys.
+//
+// The login requests made by c are not bound to the context passed to
+// the context-aware methods of a Client using it. To have them bound,
+// set c.Key to key and use AgentLoginMethod in NewParams.Visitor
+// instead.
+func SetUpAgentLogin(c *httpbakery.Client, username string, key *bakery.KeyPair) {
+	c.Key = key
+	c.VisitWebPage = AgentVisitWebPage(c.Client, username, key)
+}
+
+// AgentVisitWebPage returns a function that can be used with
+// httpbakery.Client.VisitWebPage to perform an agent login interaction
+// as described in section 3 of docs/login.txt. The Key field of the
+// httpbakery.Client must be set to key so that the client can prove
+// that it holds the agent's private key; SetUpAgentLogin does this.
+func AgentVisitWebPage(client *http.Client, username string, key *bakery.KeyPair) func(u *url.URL) error {
+	return func(u *url.URL) error {
+		lm, err := loginMethods(client, u)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return agentLogin(client, username, key, lm)
+	}
+}
+
+// agentLogin logs in as the given agent using the agent endpoint in lm.
+func agentLogin(client *http.Client, username string, key *bakery.KeyPair, lm *params.LoginMethods) error {
+	if lm.Agent == "" {
+		return ErrAgentLoginNotSupported
+	}
+	body, err := json.Marshal(params.AgentLogin{
+		Username:  params.Username(username),
+		PublicKey: &key.Public,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal agent login request")
+	}
+	req, err := http.NewRequest("POST", lm.Agent, bytes.NewReader(body))
+	if err != nil {
+		return errgo.Notef(err, "cannot create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return errgo.Notef(err, "cannot do request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var perr params.Error
+		if err := httprequest.UnmarshalJSONResponse(resp, &perr); err != nil {
+			return errgo.Notef(err, "cannot unmarshal error")
+		}
+		return errgo.WithCausef(&perr, ErrAgentLoginRejected, "agent login rejected")
+	}
+	var alr params.AgentLoginResponse
+	if err := httprequest.UnmarshalJSONResponse(resp, &alr); err != nil {
+		return errgo.Notef(err, "cannot unmarshal agent login response")
+	}
+	if !alr.AgentLogin {
+		return ErrAgentLoginRejected
+	}
+	return nil
+}
+
+// CreateAgentParams holds the parameters for CreateAgent.
+type CreateAgentParams struct {
+	// Username holds the name of the agent. As required by the
+	// identity server, it must end with "@" followed by the
+	// name of the owner.
+	Username params.Username
+
+	// Owner holds the name of the user that owns the agent.
+	Owner params.Username
+
+	// FullName optionally holds a description of the agent.
+	FullName string
+
+	// Key holds the key pair of the agent. If it is nil,
+	// a new key pair is generated.
+	Key *bakery.KeyPair
+}
+
+// CreateAgent creates an agent identity owned by p.Owner, registering
+// the public part of the agent's key pair with the identity server,
+// and returns the key pair. If the agent already exists, its public
+// keys are replaced. The client must be authenticated as the owner or
+// as an administrator.
+func (c *Client) CreateAgent(p CreateAgentParams) (*bakery.KeyPair, error) {
+	return c.CreateAgentContext(context.Background(), p)
+}
+
+// CreateAgentContext is like CreateAgent except that the request is
+// made with the given context.
+func (c *Client) CreateAgentContext(ctx context.Context, p CreateAgentParams) (*bakery.KeyPair, error) {
+	if p.Owner == "" {
+		return nil, errgo.New("no agent owner specified")
+	}
+	key := p.Key
+	if key == nil {
+		var err error
+		key, err = bakery.GenerateKey()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot generate key")
+		}
+	}
+	err := c.SetUserContext(ctx, &params.SetUserRequest{
+		Username: p.Username,
+		User: params.User{
+			Owner:      p.Owner,
+			FullName:   p.FullName,
+			PublicKeys: []*bakery.PublicKey{&key.Public},
+		},
+	})
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot create agent", errgo.Any)
+	}
+	return key, nil
+}
+
+// RotateAgentKeyParams holds the parameters for RotateAgentKey.
+type RotateAgentKeyParams struct {
+	// Username holds the name of the agent.
+	Username params.Username
+
+	// OldKey holds the public key to remove from the agent. If it
+	// is nil, all the agent's existing keys are removed.
+	OldKey *bakery.PublicKey
+
+	// NewKey holds the key pair to add to the agent. If it is nil,
+	// a new key pair is generated.
+	NewKey *bakery.KeyPair
+}
+
+// RotateAgentKey replaces a public key of the given agent with a new
+// one and returns the new key pair. The new key is added alongside the
+// existing keys and an agent login is made with it before the old key
+// is removed, so the agent can log in with one key or the other
+// throughout. If the login fails, the new key is removed again and the
+// agent's keys are left as they were. The client must be authenticated
+// as the agent's owner or as an administrator.
+//
+// If the old key cannot be removed, the new key pair is returned along
+// with the error, as the agent can already log in with it.
+func (c *Client) RotateAgentKey(p RotateAgentKeyParams) (*bakery.KeyPair, error) {
+	return c.RotateAgentKeyContext(context.Background(), p)
+}
+
+// RotateAgentKeyContext is like RotateAgentKey except that the
+// requests are made with the given context.
+func (c *Client) RotateAgentKeyContext(ctx context.Context, p RotateAgentKeyParams) (*bakery.KeyPair, error) {
+	u, err := c.UserContext(ctx, &params.UserRequest{
+		Username: p.Username,
+	})
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot get agent", errgo.Any)
+	}
+	if p.OldKey != nil && !containsKey(u.PublicKeys, p.OldKey) {
+		return nil, errgo.Newf("key %v not found for agent %q", p.OldKey, p.Username)
+	}
+	key := p.NewKey
+	if key == nil {
+		key, err = bakery.GenerateKey()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot generate key")
+		}
+	}
+	oldKeys := u.PublicKeys
+	if err := c.setAgentKeys(ctx, p.Username, u, append(oldKeys[:len(oldKeys):len(oldKeys)], &key.Public)); err != nil {
+		return nil, errgo.NoteMask(err, "cannot add new key", errgo.Any)
+	}
+	if err := c.checkAgentLogin(ctx, p.Username, key); err != nil {
+		if err1 := c.setAgentKeys(ctx, p.Username, u, oldKeys); err1 != nil {
+			return nil, errgo.Notef(err1, "cannot log in with new key (%v) and cannot remove it", err)
+		}
+		return nil, errgo.NoteMask(err, "cannot log in with new key", errgo.Any)
+	}
+	newKeys := []*bakery.PublicKey{&key.Public}
+	if p.OldKey != nil {
+		newKeys = nil
+		for _, k := range oldKeys {
+			if k != nil && *k != *p.OldKey {
+				newKeys = append(newKeys, k)
+			}
+		}
+		newKeys = append(newKeys, &key.Public)
+	}
+	if err := c.setAgentKeys(ctx, p.Username, u, newKeys); err != nil {
+		return key, errgo.NoteMask(err, "cannot remove old key", errgo.Any)
+	}
+	return key, nil
+}
+
+// setAgentKeys sets the public keys of the given agent, whose current
+// details are held in u, to keys, leaving its other details unchanged.
+// The server replaces the agent's keys with exactly those sent, so
+// an empty list clears them.
+func (c *Client) setAgentKeys(ctx context.Context, username params.Username, u *params.User, keys []*bakery.PublicKey) error {
+	if keys == nil {
+		// Send an empty list rather than null so that
+		// the agent is left with no keys.
+		keys = []*bakery.PublicKey{}
+	}
+	u1 := *u
+	u1.PublicKeys = keys
+	return c.SetUserContext(ctx, &params.SetUserRequest{
+		Username: username,
+		User:     u1,
+	})
+}
+
+// checkAgentLogin checks that the agent with the given username can
+// log in to the identity server with the given key. A new
+// httpbakery.Client is used so that no macaroons already acquired by
+// c are presented instead.
+func (c *Client) checkAgentLogin(ctx context.Context, username params.Username, key *bakery.KeyPair) error {
+	bclient := httpbakery.NewClient()
+	bclient.Key = key
+	agentClient := New(NewParams{
+		BaseURL: c.newParams.BaseURL,
+		Client:  bclient,
+		Visitor: &Visitor{
+			Methods: []LoginMethod{
+				AgentLoginMethod(bclient.Client, string(username), key),
+			},
+		},
+	})
+	_, err := agentClient.UserGroupsContext(ctx, &params.UserGroupsRequest{
+		Username: username,
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// containsKey reports whether keys contains key.
+func containsKey(keys []*bakery.PublicKey, key *bakery.PublicKey) bool {
+	for _, k := range keys {
+		if k != nil && *k == *key {
+			return true
+		}
+	}
+	return false
+}
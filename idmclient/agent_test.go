@@ -0,0 +1,299 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/idmtest"
+	"github.com/juju/identity/params"
+)
+
+type agentSuite struct{}
+
+var _ = gc.Suite(&agentSuite{})
+
+func (*agentSuite) TestAgentLogin(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", "beatles")
+	bclient := httpbakery.NewClient()
+	idmclient.SetUpAgentLogin(bclient, "bob", srv.UserPublicKey("bob"))
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+	groups, err := client.UserGroups(&params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(groups, jc.DeepEquals, []string{"beatles"})
+}
+
+func (*agentSuite) TestAgentLoginWrongKey(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	bclient := httpbakery.NewClient()
+	idmclient.SetUpAgentLogin(bclient, "bob", key)
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+	_, err = client.UserGroups(&params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `.*agent login rejected: invalid agent credentials for "bob"`)
+}
+
+func (*agentSuite) TestCreateAgent(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	key, err := client.CreateAgent(idmclient.CreateAgentParams{
+		Username: "myagent@bob",
+		Owner:    "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	u, err := client.User(&params.UserRequest{
+		Username: "myagent@bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(u.Owner, gc.Equals, params.Username("bob"))
+	c.Assert(u.PublicKeys, jc.DeepEquals, []*bakery.PublicKey{&key.Public})
+
+	// The agent can log in with the returned key.
+	bclient := httpbakery.NewClient()
+	idmclient.SetUpAgentLogin(bclient, "myagent@bob", key)
+	agentClient := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+	_, err = agentClient.UserGroups(&params.UserGroupsRequest{
+		Username: "myagent@bob",
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+func (*agentSuite) TestCreateAgentWithKey(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	key1, err := client.CreateAgent(idmclient.CreateAgentParams{
+		Username: "myagent@bob",
+		Owner:    "bob",
+		Key:      key,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(key1, gc.Equals, key)
+}
+
+func (*agentSuite) TestCreateAgentErrors(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	_, err := client.CreateAgent(idmclient.CreateAgentParams{
+		Username: "myagent@bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `no agent owner specified`)
+
+	_, err = client.CreateAgent(idmclient.CreateAgentParams{
+		Username: "myagent@alice",
+		Owner:    "alice",
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot create agent: .*not an administrator`)
+}
+
+func (*agentSuite) TestRotateAgentKey(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	oldKey, err := client.CreateAgent(idmclient.CreateAgentParams{
+		Username: "myagent@bob",
+		Owner:    "bob",
+		FullName: "My Agent",
+	})
+	c.Assert(err, gc.IsNil)
+	newKey, err := client.RotateAgentKey(idmclient.RotateAgentKeyParams{
+		Username: "myagent@bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(newKey.Public, gc.Not(gc.Equals), oldKey.Public)
+	c.Assert(srv.UserPublicKeys("myagent@bob"), jc.DeepEquals, []*bakery.PublicKey{&newKey.Public})
+
+	// The agent's other details are unchanged.
+	u, err := client.User(&params.UserRequest{
+		Username: "myagent@bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(u.Owner, gc.Equals, params.Username("bob"))
+	c.Assert(u.FullName, gc.Equals, "My Agent")
+
+	// The agent can log in with the new key but not the old one.
+	_, err = agentClient(srv, "myagent@bob", newKey).UserGroups(&params.UserGroupsRequest{
+		Username: "myagent@bob",
+	})
+	c.Assert(err, gc.IsNil)
+	_, err = agentClient(srv, "myagent@bob", oldKey).UserGroups(&params.UserGroupsRequest{
+		Username: "myagent@bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `.*agent login rejected: invalid agent credentials for "myagent@bob"`)
+}
+
+func (*agentSuite) TestRotateAgentKeyWithOldKey(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	key0, err := client.CreateAgent(idmclient.CreateAgentParams{
+		Username: "myagent@bob",
+		Owner:    "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	key1 := srv.AddUserKey("myagent@bob")
+	key2, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+
+	key, err := client.RotateAgentKey(idmclient.RotateAgentKeyParams{
+		Username: "myagent@bob",
+		OldKey:   &key0.Public,
+		NewKey:   key2,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.Equals, key2)
+	c.Assert(srv.UserPublicKeys("myagent@bob"), jc.DeepEquals, []*bakery.PublicKey{&key1.Public, &key2.Public})
+}
+
+func (*agentSuite) TestRotateAgentKeyLoginFailure(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	oldKey, err := client.CreateAgent(idmclient.CreateAgentParams{
+		Username: "myagent@bob",
+		Owner:    "bob",
+	})
+	c.Assert(err, gc.IsNil)
+
+	// A key pair whose private key does not match its public key
+	// cannot be used to log in.
+	key0, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	key1, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	_, err = client.RotateAgentKey(idmclient.RotateAgentKeyParams{
+		Username: "myagent@bob",
+		NewKey: &bakery.KeyPair{
+			Public:  key0.Public,
+			Private: key1.Private,
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot log in with new key: .*`)
+
+	// The agent's keys are left as they were.
+	c.Assert(srv.UserPublicKeys("myagent@bob"), jc.DeepEquals, []*bakery.PublicKey{&oldKey.Public})
+}
+
+func (*agentSuite) TestRotateAgentKeyLoginFailureWithNoKeys(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	err := client.SetUser(&params.SetUserRequest{
+		Username: "myagent@bob",
+		User: params.User{
+			Owner: "bob",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(srv.UserPublicKeys("myagent@bob"), gc.HasLen, 0)
+
+	key0, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	key1, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	_, err = client.RotateAgentKey(idmclient.RotateAgentKeyParams{
+		Username: "myagent@bob",
+		NewKey: &bakery.KeyPair{
+			Public:  key0.Public,
+			Private: key1.Private,
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot log in with new key: .*`)
+
+	// The new key is removed again, leaving the agent with no keys.
+	c.Assert(srv.UserPublicKeys("myagent@bob"), gc.HasLen, 0)
+}
+
+func (*agentSuite) TestRotateAgentKeyErrors(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	srv.AddUser("alice")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	_, err := client.CreateAgent(idmclient.CreateAgentParams{
+		Username: "myagent@bob",
+		Owner:    "bob",
+	})
+	c.Assert(err, gc.IsNil)
+
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	_, err = client.RotateAgentKey(idmclient.RotateAgentKeyParams{
+		Username: "myagent@bob",
+		OldKey:   &key.Public,
+	})
+	c.Assert(err, gc.ErrorMatches, `key .* not found for agent "myagent@bob"`)
+
+	_, err = client.RotateAgentKey(idmclient.RotateAgentKeyParams{
+		Username: "otheragent@bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot get agent: .*user "otheragent@bob" not found`)
+
+	aliceClient := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("alice"),
+	})
+	_, err = aliceClient.RotateAgentKey(idmclient.RotateAgentKeyParams{
+		Username: "myagent@bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot add new key: .*not an administrator`)
+}
+
+// agentClient returns a client that logs in to srv as the agent with
+// the given username and key.
+func agentClient(srv *idmtest.Server, username string, key *bakery.KeyPair) *idmclient.Client {
+	bclient := httpbakery.NewClient()
+	idmclient.SetUpAgentLogin(bclient, username, key)
+	return idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+}
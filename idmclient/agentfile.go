@@ -0,0 +1,206 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+
+	"github.com/juju/identity/params"
+)
+
+// AgentFile holds the contents of an agent file, which records the
+// credentials needed for an agent to log in to identity servers. It is
+// stored as JSON, for example:
+//
+//	{
+//		"key": {
+//			"public": "...",
+//			"private": "..."
+//		},
+//		"agents": [{
+//			"url": "https://api.jujucharms.com/identity",
+//			"username": "myagent@bob"
+//		}]
+//	}
+//
+// The same key pair is used for all the agents in the file, which may
+// hold at most one agent for each identity server. As the file holds a
+// private key, ReadAgentFile refuses to read it if it is world-readable.
+// See docs/login.txt for more details.
+type AgentFile struct {
+	// Key holds the key pair of the agents.
+	Key *bakery.KeyPair `json:"key"`
+
+	// Agents holds an entry for each identity server.
+	Agents []AgentFileEntry `json:"agents"`
+}
+
+// AgentFileEntry holds the details of an agent
+// registered with an identity server.
+type AgentFileEntry struct {
+	// URL holds the URL of the identity server.
+	URL string `json:"url"`
+
+	// Username holds the name of the agent.
+	Username params.Username `json:"username"`
+}
+
+// ErrAgentFileInsecure is the cause of the error returned by
+// ReadAgentFile when the agent file is world-readable, and by
+// CheckKeyFileMode for any world-readable file holding a private key.
+var ErrAgentFileInsecure = errgo.New("agent file is world-readable")
+
+// CheckKeyFileMode checks that a file with the given mode may be used
+// to hold a private key, which must not be readable by everyone. If it
+// may not, the cause of the returned error is ErrAgentFileInsecure. The
+// check is skipped on Windows, where file modes do not reflect access
+// permissions.
+func CheckKeyFileMode(mode os.FileMode) error {
+	if runtime.GOOS != "windows" && mode.Perm()&0004 != 0 {
+		return errgo.WithCausef(nil, ErrAgentFileInsecure, "permissions %v are too open", mode.Perm())
+	}
+	return nil
+}
+
+// ReadAgentFile reads the agent file at the given path. If the file
+// does not exist, the cause of the returned error satisfies
+// os.IsNotExist.
+func ReadAgentFile(path string) (*AgentFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot read agent file", os.IsNotExist)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read agent file")
+	}
+	if err := CheckKeyFileMode(info.Mode()); err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot read agent file %q", path), errgo.Is(ErrAgentFileInsecure))
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read agent file")
+	}
+	var f AgentFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errgo.Notef(err, "cannot parse agent file %q", path)
+	}
+	if err := f.validate(); err != nil {
+		return nil, errgo.Notef(err, "invalid agent file %q", path)
+	}
+	return &f, nil
+}
+
+// validate checks that the agent file is well formed.
+func (f *AgentFile) validate() error {
+	if f.Key == nil {
+		return errgo.New("no key found")
+	}
+	seen := make(map[string]bool)
+	for _, a := range f.Agents {
+		if a.URL == "" || a.Username == "" {
+			return errgo.New("agent with empty URL or username")
+		}
+		loc := canonicalLocation(a.URL)
+		if seen[loc] {
+			return errgo.Newf("more than one agent for %s", a.URL)
+		}
+		seen[loc] = true
+	}
+	return nil
+}
+
+// Lookup returns the agent for the identity server
+// at the given location, and reports whether it was found.
+func (f *AgentFile) Lookup(location string) (AgentFileEntry, bool) {
+	loc := canonicalLocation(location)
+	for _, a := range f.Agents {
+		if canonicalLocation(a.URL) == loc {
+			return a, true
+		}
+	}
+	return AgentFileEntry{}, false
+}
+
+// SetAgent adds the given agent to the file,
+// replacing any agent for the same location.
+func (f *AgentFile) SetAgent(e AgentFileEntry) {
+	loc := canonicalLocation(e.URL)
+	for i, a := range f.Agents {
+		if canonicalLocation(a.URL) == loc {
+			f.Agents[i] = e
+			return
+		}
+	}
+	f.Agents = append(f.Agents, e)
+}
+
+// canonicalLocation returns the identity server location
+// in a form suitable for comparison.
+func canonicalLocation(location string) string {
+	return strings.TrimSuffix(location, "/")
+}
+
+// NewAgentClient returns a client that logs in to the identity server
+// at the given location as the agent recorded for it in the agent
+// file at the given path. As with SetUpAgentLogin, the login requests
+// made by the returned client are not bound to the context passed to
+// the context-aware methods of Client.
+func NewAgentClient(path, location string) (*httpbakery.Client, error) {
+	f, err := ReadAgentFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrAgentFileInsecure), os.IsNotExist)
+	}
+	a, ok := f.Lookup(location)
+	if !ok {
+		return nil, errgo.Newf("no agent for %s found in %q", location, path)
+	}
+	client := httpbakery.NewClient()
+	SetUpAgentLogin(client, string(a.Username), f.Key)
+	return client, nil
+}
+
+// WriteAgentFile writes f to the given path. As the file holds a
+// private key, it is only readable by its owner. The file is replaced
+// atomically.
+func WriteAgentFile(path string, f *AgentFile) error {
+	data, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal agent file")
+	}
+	data = append(data, '\n')
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".agent-")
+	if err != nil {
+		return errgo.Notef(err, "cannot create agent file")
+	}
+	defer os.Remove(tmp.Name())
+	// TempFile creates files only readable by their owner,
+	// but make sure of that.
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return errgo.Notef(err, "cannot set agent file permissions")
+	}
+	_, err = tmp.Write(data)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot write agent file")
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errgo.Notef(err, "cannot write agent file")
+	}
+	return nil
+}
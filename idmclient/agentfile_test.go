@@ -0,0 +1,164 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/idmtest"
+	"github.com/juju/identity/params"
+)
+
+type agentFileSuite struct{}
+
+var _ = gc.Suite(&agentFileSuite{})
+
+func (*agentFileSuite) TestWriteRead(c *gc.C) {
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	f := &idmclient.AgentFile{
+		Key: key,
+		Agents: []idmclient.AgentFileEntry{{
+			URL:      "https://example.com/identity",
+			Username: "myagent@bob",
+		}},
+	}
+	path := filepath.Join(c.MkDir(), "agent.json")
+	err = idmclient.WriteAgentFile(path, f)
+	c.Assert(err, gc.IsNil)
+	info, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0600))
+
+	f1, err := idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f1, jc.DeepEquals, f)
+}
+
+func (*agentFileSuite) TestReadErrors(c *gc.C) {
+	dir := c.MkDir()
+	_, err := idmclient.ReadAgentFile(filepath.Join(dir, "nonexistent"))
+	c.Assert(err, gc.ErrorMatches, `cannot read agent file: .*`)
+
+	path := filepath.Join(dir, "agent.json")
+	err = ioutil.WriteFile(path, []byte("{"), 0600)
+	c.Assert(err, gc.IsNil)
+	_, err = idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.ErrorMatches, `cannot parse agent file ".*": .*`)
+
+	err = ioutil.WriteFile(path, []byte(`{"agents": []}`), 0600)
+	c.Assert(err, gc.IsNil)
+	_, err = idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.ErrorMatches, `invalid agent file ".*": no key found`)
+}
+
+func (*agentFileSuite) TestReadInsecureFile(c *gc.C) {
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	path := filepath.Join(c.MkDir(), "agent.json")
+	err = idmclient.WriteAgentFile(path, &idmclient.AgentFile{
+		Key: key,
+	})
+	c.Assert(err, gc.IsNil)
+	err = os.Chmod(path, 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.ErrorMatches, `cannot read agent file ".*": permissions -rw-r--r-- are too open`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmclient.ErrAgentFileInsecure)
+
+	// Group-readable files are allowed.
+	err = os.Chmod(path, 0640)
+	c.Assert(err, gc.IsNil)
+	_, err = idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*agentFileSuite) TestReadDuplicateAgents(c *gc.C) {
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	path := filepath.Join(c.MkDir(), "agent.json")
+	err = idmclient.WriteAgentFile(path, &idmclient.AgentFile{
+		Key: key,
+		Agents: []idmclient.AgentFileEntry{{
+			URL:      "https://example.com/identity",
+			Username: "a@bob",
+		}, {
+			URL:      "https://example.com/identity/",
+			Username: "b@bob",
+		}},
+	})
+	c.Assert(err, gc.IsNil)
+	_, err = idmclient.ReadAgentFile(path)
+	c.Assert(err, gc.ErrorMatches, `invalid agent file ".*": more than one agent for https://example.com/identity/`)
+}
+
+func (*agentFileSuite) TestLookupAndSetAgent(c *gc.C) {
+	f := &idmclient.AgentFile{
+		Agents: []idmclient.AgentFileEntry{{
+			URL:      "https://example.com/identity",
+			Username: "a@bob",
+		}},
+	}
+	a, ok := f.Lookup("https://example.com/identity/")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(a.Username, gc.Equals, params.Username("a@bob"))
+	_, ok = f.Lookup("https://other.example.com/identity")
+	c.Assert(ok, gc.Equals, false)
+
+	f.SetAgent(idmclient.AgentFileEntry{
+		URL:      "https://other.example.com/identity",
+		Username: "b@bob",
+	})
+	f.SetAgent(idmclient.AgentFileEntry{
+		URL:      "https://example.com/identity/",
+		Username: "c@bob",
+	})
+	c.Assert(f.Agents, jc.DeepEquals, []idmclient.AgentFileEntry{{
+		URL:      "https://example.com/identity/",
+		Username: "c@bob",
+	}, {
+		URL:      "https://other.example.com/identity",
+		Username: "b@bob",
+	}})
+}
+
+func (*agentFileSuite) TestNewAgentClient(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", "beatles")
+	path := filepath.Join(c.MkDir(), "agent.json")
+	err := idmclient.WriteAgentFile(path, &idmclient.AgentFile{
+		Key: srv.UserPublicKey("bob"),
+		Agents: []idmclient.AgentFileEntry{{
+			URL:      "https://example.com/identity",
+			Username: "alice",
+		}, {
+			URL:      srv.URL.String(),
+			Username: "bob",
+		}},
+	})
+	c.Assert(err, gc.IsNil)
+
+	bclient, err := idmclient.NewAgentClient(path, srv.URL.String())
+	c.Assert(err, gc.IsNil)
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+	groups, err := client.UserGroups(&params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(groups, jc.DeepEquals, []string{"beatles"})
+
+	_, err = idmclient.NewAgentClient(path, "https://other.example.com")
+	c.Assert(err, gc.ErrorMatches, `no agent for https://other.example.com found in ".*"`)
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/juju/identity/params"
+)
+
+// AuthHandlerParams holds the parameters for NewAuthHandler.
+type AuthHandlerParams struct {
+	// Handler holds the handler that serves
+	// authenticated requests.
+	Handler http.Handler
+
+	// Bakery holds the service used to check the
+	// macaroons in requests and to mint new ones.
+	Bakery *bakery.Service
+
+	// IdentityLocation holds the URL of the identity server
+	// that discharges the minted macaroons, for example
+	// Production.
+	IdentityLocation string
+
+	// MacaroonExpiry, if non-zero, holds the length of time
+	// for which minted macaroons are valid.
+	MacaroonExpiry time.Duration
+
+	// ACL, if non-nil, holds the ACL that authenticated users
+	// must satisfy. It is checked with PermChecker, which must
+	// be non-nil if ACL is non-nil.
+	ACL         params.ACL
+	PermChecker *PermChecker
+}
+
+// NewAuthHandler returns a handler that authenticates requests with
+// macaroons declaring a username, as discharged by the identity server,
+// before passing them on to p.Handler. The name of the authenticated
+// user can be retrieved from the request's context with
+// UsernameFromContext.
+//
+// When a request is not authenticated, the handler responds with a
+// discharge-required error holding a macaroon with a third party
+// caveat addressed to the identity server, so that an
+// httpbakery.Client can acquire a discharge and retry the request.
+//
+// NewAuthHandler panics if p.ACL is non-nil and p.PermChecker is nil.
+func NewAuthHandler(p AuthHandlerParams) http.Handler {
+	if p.ACL != nil && p.PermChecker == nil {
+		panic("idmclient: NewAuthHandler called with an ACL but no PermChecker")
+	}
+	return &authHandler{
+		p: p,
+	}
+}
+
+type authHandler struct {
+	p AuthHandlerParams
+}
+
+// ServeHTTP implements http.Handler.ServeHTTP.
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	username, err := h.authenticate(req)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if h.p.ACL != nil {
+		ok, err := h.p.PermChecker.AllowACLContext(req.Context(), username, h.p.ACL)
+		if err != nil {
+			writeAuthError(w, errgo.Notef(err, "cannot check permissions"))
+			return
+		}
+		if !ok {
+			writeAuthError(w, errgo.WithCausef(nil, params.ErrForbidden, "access denied for user %q", username))
+			return
+		}
+	}
+	h.p.Handler.ServeHTTP(w, req.WithContext(ContextWithUsername(req.Context(), username)))
+}
+
+// authenticate checks that the request is authenticated with a
+// macaroon discharged by the identity server and returns the name of
+// the authenticated user.
+func (h *authHandler) authenticate(req *http.Request) (string, error) {
+	attrs, verr := httpbakery.CheckRequest(h.p.Bakery, req, nil, checkers.New(checkers.TimeBefore))
+	if verr == nil {
+		if username := attrs["username"]; username != "" {
+			return username, nil
+		}
+		verr = errgo.New("no username declared")
+	} else if _, ok := errgo.Cause(verr).(*bakery.VerificationError); !ok {
+		return "", errgo.Mask(verr, errgo.Any)
+	}
+	m, err := NewAuthMacaroon(h.p.Bakery, h.p.IdentityLocation, h.p.MacaroonExpiry)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return "", httpbakery.NewDischargeRequiredErrorForRequest(m, "", verr, req)
+}
+
+// NewAuthMacaroon mints a macaroon with b that has a third party caveat
+// addressed to the identity server at identityLocation, which can only
+// be discharged by authenticating as a user. The discharge declares
+// the username. If expiry is non-zero, the macaroon is valid for only
+// that length of time.
+func NewAuthMacaroon(b *bakery.Service, identityLocation string, expiry time.Duration) (*macaroon.Macaroon, error) {
+	caveats := []checkers.Caveat{{
+		Location:  identityLocation + "/v1/discharger",
+		Condition: "is-authenticated-user",
+	}}
+	if expiry != 0 {
+		caveats = append(caveats, checkers.TimeBeforeCaveat(time.Now().Add(expiry)))
+	}
+	m, err := b.NewMacaroon("", nil, caveats)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot mint macaroon")
+	}
+	return m, nil
+}
+
+// writeAuthError writes an error response for the given error.
+func writeAuthError(w http.ResponseWriter, err error) {
+	if berr, ok := errgo.Cause(err).(*httpbakery.Error); ok {
+		status, body := httpbakery.ErrorToResponse(berr)
+		httprequest.WriteJSON(w, status, body)
+		return
+	}
+	status := http.StatusInternalServerError
+	perr := &params.Error{
+		Message: err.Error(),
+	}
+	if errgo.Cause(err) == params.ErrForbidden {
+		status = http.StatusForbidden
+		perr.Code = params.ErrForbidden
+	}
+	httprequest.WriteJSON(w, status, perr)
+}
+
+type usernameKey struct{}
+
+// ContextWithUsername returns a copy of ctx that holds the
+// given username.
+func ContextWithUsername(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, usernameKey{}, username)
+}
+
+// UsernameFromContext returns the username held in ctx, as
+// added by ContextWithUsername, and reports whether there
+// was one.
+func UsernameFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(usernameKey{}).(string)
+	return username, ok
+}
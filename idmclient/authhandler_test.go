@@ -0,0 +1,141 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/idmtest"
+	"github.com/juju/identity/params"
+)
+
+type authHandlerSuite struct{}
+
+var _ = gc.Suite(&authHandlerSuite{})
+
+// newAuthServer returns a server that serves the name of the
+// authenticated user, using the given identity server and ACL.
+func newAuthServer(c *gc.C, idsrv *idmtest.Server, acl string) *httptest.Server {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Locator: idsrv,
+	})
+	c.Assert(err, gc.IsNil)
+	p := idmclient.AuthHandlerParams{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			username, ok := idmclient.UsernameFromContext(req.Context())
+			if !ok {
+				http.Error(w, "no username", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "hello %s", username)
+		}),
+		Bakery:           svc,
+		IdentityLocation: idsrv.URL.String(),
+		MacaroonExpiry:   time.Hour,
+	}
+	if acl != "" {
+		p.ACL, err = params.ParseACL(acl)
+		c.Assert(err, gc.IsNil)
+		p.PermChecker = idmclient.NewPermChecker(idmclient.New(idmclient.NewParams{
+			BaseURL: idsrv.URL.String(),
+			Client:  idsrv.Client("admin"),
+		}), time.Hour)
+	}
+	return httptest.NewServer(idmclient.NewAuthHandler(p))
+}
+
+var authHandlerTests = []struct {
+	about        string
+	acl          string
+	user         string
+	expectStatus int
+	expectBody   string
+}{{
+	about:        "no ACL",
+	user:         "bob",
+	expectStatus: http.StatusOK,
+	expectBody:   "hello bob",
+}, {
+	about:        "allowed by ACL",
+	acl:          "beatles",
+	user:         "bob",
+	expectStatus: http.StatusOK,
+	expectBody:   "hello bob",
+}, {
+	about:        "denied by ACL",
+	acl:          "beatles, !bob",
+	user:         "bob",
+	expectStatus: http.StatusForbidden,
+	expectBody:   `.*access denied for user \\"bob\\".*`,
+}, {
+	about:        "not in ACL",
+	acl:          "beatles",
+	user:         "alice",
+	expectStatus: http.StatusForbidden,
+	expectBody:   `.*access denied for user \\"alice\\".*`,
+}}
+
+func (s *authHandlerSuite) TestAuthHandler(c *gc.C) {
+	idsrv := idmtest.NewServer()
+	defer idsrv.Close()
+	idsrv.AddUser("admin", idmtest.AdminGroup)
+	idsrv.AddUser("bob", "beatles")
+	idsrv.AddUser("alice")
+	for i, test := range authHandlerTests {
+		c.Logf("%d. %s", i, test.about)
+		srv := newAuthServer(c, idsrv, test.acl)
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		c.Assert(err, gc.IsNil)
+		resp, err := idsrv.Client(test.user).Do(req)
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(resp.StatusCode, gc.Equals, test.expectStatus)
+		c.Assert(string(body), gc.Matches, test.expectBody+"\n?")
+		srv.Close()
+	}
+}
+
+func (s *authHandlerSuite) TestDischargeRequired(c *gc.C) {
+	idsrv := idmtest.NewServer()
+	defer idsrv.Close()
+	srv := newAuthServer(c, idsrv, "")
+	defer srv.Close()
+
+	// A client that does not understand macaroons
+	// sees the discharge-required error.
+	resp, err := http.Get(srv.URL)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusProxyAuthRequired)
+	c.Assert(string(body), gc.Matches, `.*"Code":"macaroon discharge required".*\n?`)
+}
+
+func (s *authHandlerSuite) TestACLWithoutPermChecker(c *gc.C) {
+	acl, err := params.ParseACL("beatles")
+	c.Assert(err, gc.IsNil)
+	c.Assert(func() {
+		idmclient.NewAuthHandler(idmclient.AuthHandlerParams{
+			ACL: acl,
+		})
+	}, gc.PanicMatches, `idmclient: NewAuthHandler called with an ACL but no PermChecker`)
+}
+
+func (s *authHandlerSuite) TestUsernameFromContextNotFound(c *gc.C) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	c.Assert(err, gc.IsNil)
+	_, ok := idmclient.UsernameFromContext(req.Context())
+	c.Assert(ok, gc.Equals, false)
+}
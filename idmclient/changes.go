@@ -0,0 +1,78 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/identity/params"
+)
+
+// watchTimeout holds the length of time for which the identity server
+// is asked to wait for a change in each request made by
+// WatchUserChanges.
+const watchTimeout = time.Minute
+
+// UserChanges returns the changes made to users after p.Since, waiting
+// for up to p.Timeout milliseconds for a change if there are none.
+func (c *Client) UserChanges(p *params.UserChangesRequest) (*params.UserChangesResponse, error) {
+	var r *params.UserChangesResponse
+	err := c.Client.Call(p, &r)
+	return r, err
+}
+
+// UserChangesContext is like UserChanges except that the request is
+// made with the given context.
+func (c *Client) UserChangesContext(ctx context.Context, p *params.UserChangesRequest) (*params.UserChangesResponse, error) {
+	var r *params.UserChangesResponse
+	err := c.withContext(ctx).Client.Call(p, &r)
+	return r, err
+}
+
+// WatchUserChanges watches the identity server for changes to users,
+// evicting the cache entry of each user that changes, until ctx is
+// cancelled. As users may have changed before it started watching, it
+// first evicts all entries from the cache.
+//
+// When ctx is cancelled, it returns ctx.Err(). It also returns if the
+// changes cannot be fetched from the identity server, in which case
+// it is up to the caller to decide whether to call it again.
+func (c *PermChecker) WatchUserChanges(ctx context.Context) error {
+	resp, err := c.p.Client.UserChangesContext(ctx, &params.UserChangesRequest{
+		LatestOnly: true,
+	})
+	if err != nil {
+		return watchError(ctx, err)
+	}
+	c.CacheEvictAll()
+	since := resp.Latest
+	for {
+		resp, err := c.p.Client.UserChangesContext(ctx, &params.UserChangesRequest{
+			Since:   since,
+			Timeout: int(watchTimeout / time.Millisecond),
+		})
+		if err != nil {
+			return watchError(ctx, err)
+		}
+		if resp.Truncated {
+			c.CacheEvictAll()
+		}
+		for _, change := range resp.Changes {
+			c.CacheEvict(string(change.Username))
+		}
+		since = resp.Latest
+	}
+}
+
+// watchError returns the error that WatchUserChanges should return
+// when a request to the identity server fails with the given error.
+func watchError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errgo.Notef(err, "cannot watch user changes")
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/idmtest"
+)
+
+type changesSuite struct{}
+
+var _ = gc.Suite(&changesSuite{})
+
+func (s *changesSuite) TestWatchUserChanges(c *gc.C) {
+	srv := idmtest.NewServer()
+	defer srv.Close()
+	srv.AddUser("alice")
+	srv.AddUser("bob", "stones")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("alice"),
+	})
+	pc := idmclient.NewPermChecker(client, time.Hour)
+	ok, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- pc.WatchUserChanges(ctx)
+	}()
+
+	// Changing the user's groups evicts the stale cache entry.
+	srv.AddUser("bob", "beatles")
+	waitFor(c, func() bool {
+		ok, err := pc.Allow("bob", []string{"beatles"})
+		c.Assert(err, gc.IsNil)
+		return ok
+	})
+
+	cancel()
+	select {
+	case err := <-done:
+		c.Assert(err, gc.Equals, context.Canceled)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("WatchUserChanges did not return after cancel")
+	}
+}
+
+func (s *changesSuite) TestWatchUserChangesError(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+	err := pc.WatchUserChanges(context.Background())
+	c.Assert(err, gc.ErrorMatches, `cannot watch user changes: .*`)
+}
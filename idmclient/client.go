@@ -4,6 +4,7 @@
 package idmclient
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/url"
@@ -26,6 +27,9 @@ const (
 // Client represents the client of an identity server.
 type Client struct {
 	client
+
+	// newParams holds the parameters used to create the client.
+	newParams NewParams
 }
 
 // NewParams holds the parameters for creating a new client.
@@ -38,23 +42,45 @@ type NewParams struct {
 
 	// AuthPassword holds the password for admin login.
 	AuthPassword string
+
+	// Visitor optionally holds the visitor used to log in to the
+	// identity server. If it is set, it is used in place of
+	// Client.VisitWebPage. Unlike a VisitWebPage function, its
+	// login requests are made with the context passed to the
+	// context-aware methods, so they are cancelled along with it.
+	Visitor *Visitor
 }
 
 // New returns a new client.
 func New(p NewParams) *Client {
 	var c Client
+	if p.Client == nil {
+		// Create the default client once so that the
+		// context-aware methods, which derive their clients
+		// from it, share its cookies.
+		p.Client = httpbakery.NewClient()
+	}
+	c.newParams = p
+	if p.Visitor != nil {
+		p.Client = bakeryClientWithVisitor(context.Background(), p.Client, p.Visitor)
+	}
 	c.Client.BaseURL = p.BaseURL
+	c.Client.Doer = newDoer(p)
+	c.Client.UnmarshalError = httprequest.ErrorUnmarshaler(new(params.Error))
+	return &c
+}
+
+// newDoer returns the httprequest.Doer to use for a client
+// created with the given parameters.
+func newDoer(p NewParams) httprequest.Doer {
 	if p.AuthUsername != "" {
-		c.Client.Doer = &basicAuthClient{
+		return &basicAuthClient{
 			client:   p.Client,
 			user:     p.AuthUsername,
 			password: p.AuthPassword,
 		}
-	} else {
-		c.Client.Doer = p.Client
 	}
-	c.Client.UnmarshalError = httprequest.ErrorUnmarshaler(new(params.Error))
-	return &c
+	return p.Client
 }
 
 // basicAuthClient wraps a bakery.Client, adding a basic auth
@@ -84,31 +110,20 @@ func UbuntuSSOOAuthVisitWebPage(client *http.Client, tok *usso.SSOData) func(u *
 }
 
 func ussoOAuthVisit(client *http.Client, tok *usso.SSOData, u *url.URL) error {
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		return errgo.Notef(err, "cannot create request")
-	}
-	req.Header.Set("Accept", "application/json")
-	resp, err := client.Do(req)
+	lm, err := loginMethods(client, u)
 	if err != nil {
-		return errgo.Notef(err, "cannot do request")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		var herr httpbakery.Error
-		if err := httprequest.UnmarshalJSONResponse(resp, &herr); err != nil {
-			return errgo.Notef(err, "cannot unmarshal error")
-		}
-		return &herr
-	}
-	var lm params.LoginMethods
-	if err := httprequest.UnmarshalJSONResponse(resp, &lm); err != nil {
-		return errgo.Notef(err, "cannot unmarshal login methods")
+		return errgo.Mask(err, errgo.Any)
 	}
 	if lm.UbuntuSSOOAuth == "" {
 		return errgo.New("Ubuntu SSO OAuth login not supported")
 	}
-	req, err = http.NewRequest("GET", lm.UbuntuSSOOAuth, nil)
+	return ussoOAuthLogin(client, tok, lm.UbuntuSSOOAuth)
+}
+
+// ussoOAuthLogin logs in by sending a request signed with the given
+// token to the given Ubuntu SSO OAuth login endpoint.
+func ussoOAuthLogin(client *http.Client, tok *usso.SSOData, endpoint string) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		return errgo.Notef(err, "cannot create request")
 	}
@@ -123,7 +138,7 @@ func ussoOAuthVisit(client *http.Client, tok *usso.SSOData, u *url.URL) error {
 	if err := tok.SignRequest(&rp, req); err != nil {
 		return errgo.Notef(err, "cannot sign request")
 	}
-	resp, err = client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return errgo.Notef(err, "cannot do request")
 	}
@@ -138,4 +153,31 @@ func ussoOAuthVisit(client *http.Client, tok *usso.SSOData, u *url.URL) error {
 	return &herr
 }
 
+// loginMethods fetches the login methods supported by the
+// identity server from the given visit URL.
+func loginMethods(client *http.Client, u *url.URL) (*params.LoginMethods, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create request")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot do request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var herr httpbakery.Error
+		if err := httprequest.UnmarshalJSONResponse(resp, &herr); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal error")
+		}
+		return nil, &herr
+	}
+	var lm params.LoginMethods
+	if err := httprequest.UnmarshalJSONResponse(resp, &lm); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal login methods")
+	}
+	return &lm, nil
+}
+
 //go:generate httprequest-generate-client $IDM_SERVER_REPO/internal/v1 apiHandler client
@@ -0,0 +1,184 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/juju/identity/params"
+)
+
+// The methods below are context-aware variants of the methods in
+// client_generated.go and should be kept in sync with them.
+
+// PublicKeyContext is like PublicKey except that the request is made
+// with the given context.
+func (c *Client) PublicKeyContext(ctx context.Context, p *params.PublicKeyRequest) (*params.PublicKeyResponse, error) {
+	return c.withContext(ctx).PublicKey(p)
+}
+
+// QueryUsersContext is like QueryUsers except that the request is made
+// with the given context.
+func (c *Client) QueryUsersContext(ctx context.Context, p *params.QueryUsersRequest) ([]string, error) {
+	return c.withContext(ctx).QueryUsers(p)
+}
+
+// SetUserContext is like SetUser except that the request is made
+// with the given context.
+func (c *Client) SetUserContext(ctx context.Context, p *params.SetUserRequest) error {
+	return c.withContext(ctx).SetUser(p)
+}
+
+// SetUserExtraInfoContext is like SetUserExtraInfo except that the request is made
+// with the given context.
+func (c *Client) SetUserExtraInfoContext(ctx context.Context, p *params.SetUserExtraInfoRequest) error {
+	return c.withContext(ctx).SetUserExtraInfo(p)
+}
+
+// SetUserExtraInfoItemContext is like SetUserExtraInfoItem except that the request is made
+// with the given context.
+func (c *Client) SetUserExtraInfoItemContext(ctx context.Context, p *params.SetUserExtraInfoItemRequest) error {
+	return c.withContext(ctx).SetUserExtraInfoItem(p)
+}
+
+// UserContext is like User except that the request is made
+// with the given context.
+func (c *Client) UserContext(ctx context.Context, p *params.UserRequest) (*params.User, error) {
+	return c.withContext(ctx).User(p)
+}
+
+// UserExtraInfoContext is like UserExtraInfo except that the request is made
+// with the given context.
+func (c *Client) UserExtraInfoContext(ctx context.Context, p *params.UserExtraInfoRequest) (map[string]interface{}, error) {
+	return c.withContext(ctx).UserExtraInfo(p)
+}
+
+// UserExtraInfoItemContext is like UserExtraInfoItem except that the request is made
+// with the given context.
+func (c *Client) UserExtraInfoItemContext(ctx context.Context, p *params.UserExtraInfoItemRequest) (interface{}, error) {
+	return c.withContext(ctx).UserExtraInfoItem(p)
+}
+
+// UserGroupsContext is like UserGroups except that the request is made
+// with the given context.
+func (c *Client) UserGroupsContext(ctx context.Context, p *params.UserGroupsRequest) ([]string, error) {
+	return c.withContext(ctx).UserGroups(p)
+}
+
+// UserIDPGroupsContext is like UserIDPGroups except that the request is made
+// with the given context.
+func (c *Client) UserIDPGroupsContext(ctx context.Context, p *params.UserIDPGroupsRequest) ([]string, error) {
+	return c.withContext(ctx).UserIDPGroups(p)
+}
+
+// UserTokenContext is like UserToken except that the request is made
+// with the given context.
+func (c *Client) UserTokenContext(ctx context.Context, p *params.UserTokenRequest) (*macaroon.Macaroon, error) {
+	return c.withContext(ctx).UserToken(p)
+}
+
+// VerifyTokenContext is like VerifyToken except that the request is made
+// with the given context.
+func (c *Client) VerifyTokenContext(ctx context.Context, p *params.VerifyTokenRequest) (map[string]string, error) {
+	return c.withContext(ctx).VerifyToken(p)
+}
+
+// withContext returns a copy of c.client that makes all its requests,
+// including those made while discharging macaroons and, if a Visitor
+// was specified, those made while logging in, using ctx. Any
+// VisitWebPage function is abandoned if ctx is cancelled.
+func (c *Client) withContext(ctx context.Context) *client {
+	p := c.newParams
+	p.Client = BakeryClientWithContext(ctx, p.Client)
+	if p.Visitor != nil {
+		p.Client = bakeryClientWithVisitor(ctx, p.Client, p.Visitor)
+	}
+	c1 := c.client
+	c1.Client.Doer = newDoer(p)
+	return &c1
+}
+
+// BakeryClientWithContext returns a copy of c that makes all its
+// requests, including those made while discharging macaroons, using
+// ctx. Any VisitWebPage function is abandoned if ctx is cancelled.
+func BakeryClientWithContext(ctx context.Context, c *httpbakery.Client) *httpbakery.Client {
+	c1 := *c
+	hc := http.DefaultClient
+	if c.Client != nil {
+		hc = c.Client
+	}
+	hc1 := *hc
+	transport := hc1.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	hc1.Transport = &contextTransport{
+		ctx:       ctx,
+		transport: transport,
+	}
+	c1.Client = &hc1
+	if visit := c.VisitWebPage; visit != nil {
+		c1.VisitWebPage = func(u *url.URL) error {
+			return visitWithContext(ctx, visit, u)
+		}
+	}
+	return &c1
+}
+
+// bakeryClientWithVisitor returns a copy of c that logs in using
+// v.VisitWebPageContext, passing it ctx and c's HTTP client.
+func bakeryClientWithVisitor(ctx context.Context, c *httpbakery.Client, v *Visitor) *httpbakery.Client {
+	c1 := *c
+	hc := http.DefaultClient
+	if c.Client != nil {
+		hc = c.Client
+	}
+	c1.VisitWebPage = func(u *url.URL) error {
+		return visitWithContext(ctx, func(u *url.URL) error {
+			return v.VisitWebPageContext(ctx, hc, u)
+		}, u)
+	}
+	return &c1
+}
+
+// visitWithContext calls visit(u), returning early if ctx
+// is cancelled before it returns.
+func visitWithContext(ctx context.Context, visit func(*url.URL) error, u *url.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- visit(u)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// contextTransport is an http.RoundTripper that
+// makes all requests with a given context.
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip.
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.ctx.Err(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.transport.RoundTrip(req.WithContext(t.ctx))
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/idmtest"
+	"github.com/juju/identity/params"
+)
+
+type contextSuite struct{}
+
+var _ = gc.Suite(&contextSuite{})
+
+func (*contextSuite) TestCallWithContext(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", "beatles")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	groups, err := client.UserGroupsContext(context.Background(), &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(groups, jc.DeepEquals, []string{"beatles"})
+}
+
+func (*contextSuite) TestHungServer(c *gc.C) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL,
+		Client:  httpbakery.NewClient(),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.UserGroupsContext(ctx, &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `.*context deadline exceeded`)
+}
+
+func (*contextSuite) TestCancelDuringVisit(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	cancelled := make(chan struct{})
+	loginSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		close(cancelled)
+	}))
+	defer loginSrv.Close()
+	visiting := make(chan struct{})
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  httpbakery.NewClient(),
+		Visitor: &idmclient.Visitor{
+			Methods: []idmclient.LoginMethod{
+				&blockingLoginMethod{
+					url:      loginSrv.URL,
+					visiting: visiting,
+				},
+			},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-visiting
+		cancel()
+	}()
+	_, err := client.UserGroupsContext(ctx, &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `.*context canceled`)
+
+	// The login request in flight is cancelled too.
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("login request not cancelled")
+	}
+}
+
+func (*contextSuite) TestCancelDuringVisitWebPage(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	unblock := make(chan struct{})
+	defer close(unblock)
+	visiting := make(chan struct{})
+	bclient := httpbakery.NewClient()
+	bclient.VisitWebPage = func(*url.URL) error {
+		close(visiting)
+		<-unblock
+		return nil
+	}
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-visiting
+		cancel()
+	}()
+	_, err := client.UserGroupsContext(ctx, &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `.*context canceled`)
+}
+
+// blockingLoginMethod is a ContextLoginMethod that logs in by
+// making a request to url, first closing visiting.
+type blockingLoginMethod struct {
+	url      string
+	visiting chan struct{}
+}
+
+func (m *blockingLoginMethod) Name() string {
+	return "blocking"
+}
+
+func (m *blockingLoginMethod) Login(visitURL *url.URL, lm *params.LoginMethods) error {
+	return m.LoginContext(context.Background(), http.DefaultClient, visitURL, lm)
+}
+
+func (m *blockingLoginMethod) LoginContext(_ context.Context, client *http.Client, _ *url.URL, _ *params.LoginMethods) error {
+	close(m.visiting)
+	resp, err := client.Get(m.url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (*contextSuite) TestPermCheckerAllowContext(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("alice", "somegroup")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("alice"),
+	})
+	pc := idmclient.NewPermChecker(client, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := pc.AllowContext(ctx, "alice", []string{"somegroup"})
+	c.Assert(err, gc.ErrorMatches, `cannot fetch groups: .*context canceled`)
+
+	ok, err := pc.AllowContext(context.Background(), "alice", []string{"somegroup"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+}
@@ -0,0 +1,14 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"time"
+)
+
+// SetPermCheckerNow sets the function used by pc
+// to find out the current time.
+func SetPermCheckerNow(pc *PermChecker, now func() time.Time) {
+	pc.now = now
+}
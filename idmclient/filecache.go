@@ -0,0 +1,122 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// FileGroupCache is an implementation of GroupCache that stores each
+// entry in a file in a directory. It can be shared by processes on the
+// same host, so that they can share the results of group lookups.
+//
+// Entries are written atomically, so a reader never sees a partially
+// written entry. Expired entries are removed when they are next read.
+type FileGroupCache struct {
+	dir string
+}
+
+// fileCacheEntry holds the contents of a FileGroupCache file.
+type fileCacheEntry struct {
+	Entry    *CacheEntry `json:"entry"`
+	Deadline time.Time   `json:"deadline"`
+}
+
+// NewFileGroupCache returns a cache that stores entries in the given
+// directory, creating it if necessary. The directory should not be
+// used for any other purpose.
+func NewFileGroupCache(dir string) (*FileGroupCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errgo.Notef(err, "cannot create cache directory")
+	}
+	return &FileGroupCache{
+		dir: dir,
+	}, nil
+}
+
+// Get implements GroupCache.Get.
+func (c *FileGroupCache) Get(username string) *CacheEntry {
+	path := c.path(username)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var fe fileCacheEntry
+	if err := json.Unmarshal(data, &fe); err != nil || fe.Entry == nil {
+		return nil
+	}
+	if !time.Now().Before(fe.Deadline) {
+		os.Remove(path)
+		return nil
+	}
+	return fe.Entry
+}
+
+// Set implements GroupCache.Set.
+func (c *FileGroupCache) Set(username string, e *CacheEntry, ttl time.Duration) {
+	data, err := json.Marshal(fileCacheEntry{
+		Entry:    e,
+		Deadline: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return
+	}
+	// Write to a temporary file and rename it into place so that
+	// concurrent readers never see a partial entry. The temporary
+	// file's name does not match the pattern used by EvictAll and
+	// Stats.
+	f, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(username))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// Evict implements GroupCache.Evict.
+func (c *FileGroupCache) Evict(username string) {
+	os.Remove(c.path(username))
+}
+
+// EvictAll implements GroupCache.EvictAll.
+func (c *FileGroupCache) EvictAll() {
+	for _, path := range c.paths() {
+		os.Remove(path)
+	}
+}
+
+// Stats implements GroupCache.Stats. As the cache is
+// unbounded, no entries are ever evicted to make room.
+func (c *FileGroupCache) Stats() GroupCacheStats {
+	return GroupCacheStats{
+		Size: len(c.paths()),
+	}
+}
+
+// path returns the path of the file holding the
+// entry for the given user.
+func (c *FileGroupCache) path(username string) string {
+	return filepath.Join(c.dir, url.QueryEscape(username)+".json")
+}
+
+// paths returns the paths of all the entry files.
+func (c *FileGroupCache) paths() []string {
+	paths, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	return paths
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	"path/filepath"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/identity/idmclient"
+)
+
+type fileCacheSuite struct{}
+
+var _ = gc.Suite(&fileCacheSuite{})
+
+func (s *fileCacheSuite) TestGetSetEvict(c *gc.C) {
+	cache, err := idmclient.NewFileGroupCache(filepath.Join(c.MkDir(), "cache"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(cache.Get("bob"), gc.IsNil)
+
+	expires := time.Now().Add(time.Hour).Round(0).UTC()
+	bobEntry := &idmclient.CacheEntry{
+		Groups:  map[string]bool{"beatles": true},
+		Expires: expires,
+	}
+	cache.Set("bob", bobEntry, time.Hour)
+	cache.Set("alice@external", &idmclient.CacheEntry{
+		Groups:       map[string]bool{},
+		Error:        "identity is down",
+		ErrorExpires: expires,
+	}, time.Hour)
+	c.Assert(cache.Get("bob"), jc.DeepEquals, bobEntry)
+	c.Assert(cache.Get("alice@external").Groups, jc.DeepEquals, map[string]bool{})
+	c.Assert(cache.Get("alice@external").Error, gc.Equals, "identity is down")
+	c.Assert(cache.Stats(), jc.DeepEquals, idmclient.GroupCacheStats{
+		Size: 2,
+	})
+
+	cache.Evict("bob")
+	c.Assert(cache.Get("bob"), gc.IsNil)
+	c.Assert(cache.Stats().Size, gc.Equals, 1)
+
+	cache.EvictAll()
+	c.Assert(cache.Get("alice@external"), gc.IsNil)
+	c.Assert(cache.Stats().Size, gc.Equals, 0)
+}
+
+func (s *fileCacheSuite) TestExpiredEntry(c *gc.C) {
+	cache, err := idmclient.NewFileGroupCache(c.MkDir())
+	c.Assert(err, gc.IsNil)
+	cache.Set("bob", &idmclient.CacheEntry{
+		Groups: map[string]bool{"beatles": true},
+	}, -time.Second)
+	c.Assert(cache.Get("bob"), gc.IsNil)
+	c.Assert(cache.Stats().Size, gc.Equals, 0)
+}
+
+func (s *fileCacheSuite) TestSharedBetweenPermCheckers(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles")
+	dir := c.MkDir()
+	newPermChecker := func() *idmclient.PermChecker {
+		cache, err := idmclient.NewFileGroupCache(dir)
+		c.Assert(err, gc.IsNil)
+		return idmclient.NewPermCheckerWithParams(idmclient.PermCheckerParams{
+			Client:    srv.client(),
+			CacheTime: time.Hour,
+			Cache:     cache,
+		})
+	}
+	pc1 := newPermChecker()
+	pc2 := newPermChecker()
+
+	ok, err := pc1.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	// The second checker uses the result fetched by the first.
+	ok, err = pc2.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+	c.Assert(pc2.Stats().Hits, gc.Equals, int64(1))
+
+	// Evicting from one checker evicts from both.
+	srv.setGroups("bob")
+	pc2.CacheEvict("bob")
+	ok, err = pc1.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 2)
+}
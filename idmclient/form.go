@@ -0,0 +1,146 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/juju/httprequest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/environschema.v1"
+	"gopkg.in/juju/environschema.v1/form"
+
+	"github.com/juju/identity/params"
+)
+
+// FormVisitWebPage returns a function that can be used with
+// httpbakery.Client.VisitWebPage to log in by filling in the login form
+// described by the identity server. The given filler is used to
+// fill in the form. Use FormLoginMethod in NewParams.Visitor instead
+// to have the login requests bound to the context passed to the
+// context-aware methods of Client.
+func FormVisitWebPage(client *http.Client, filler form.Filler) func(u *url.URL) error {
+	m := FormLoginMethod(client, filler)
+	return func(u *url.URL) error {
+		lm, err := loginMethods(client, u)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return m.Login(u, lm)
+	}
+}
+
+// FormLoginMethod returns a LoginMethod that logs in by fetching the
+// login form schema from the identity server, using filler to fill it
+// in and submitting the result.
+func FormLoginMethod(client *http.Client, filler form.Filler) LoginMethod {
+	return &formLoginMethod{
+		client: client,
+		filler: filler,
+	}
+}
+
+// NewTerminalFormFiller returns a form.Filler that writes prompts
+// for form values to out and reads the values from in, which are
+// typically os.Stdin and os.Stderr. Values for secret fields are not
+// echoed when in is a terminal.
+func NewTerminalFormFiller(in io.Reader, out io.Writer) form.Filler {
+	return &form.IOFiller{
+		In:  in,
+		Out: out,
+	}
+}
+
+type formLoginMethod struct {
+	client *http.Client
+	filler form.Filler
+}
+
+// Name implements LoginMethod.Name.
+func (m *formLoginMethod) Name() string {
+	return "form"
+}
+
+// Login implements LoginMethod.Login.
+func (m *formLoginMethod) Login(visitURL *url.URL, lm *params.LoginMethods) error {
+	return m.LoginContext(context.Background(), m.client, visitURL, lm)
+}
+
+// LoginContext implements ContextLoginMethod.LoginContext.
+func (m *formLoginMethod) LoginContext(_ context.Context, client *http.Client, _ *url.URL, lm *params.LoginMethods) error {
+	if lm.Form == "" {
+		return errgo.WithCausef(nil, ErrLoginMethodNotSupported, "form login not supported")
+	}
+	schema, err := formSchema(client, lm.Form)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	values, err := m.filler.Fill(form.Form{
+		Title:  "Log in to identity",
+		Fields: schema,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot fill login form")
+	}
+	body, err := json.Marshal(params.LoginBody{
+		Form: values,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal login form")
+	}
+	req, err := http.NewRequest("POST", lm.Form, bytes.NewReader(body))
+	if err != nil {
+		return errgo.Notef(err, "cannot create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return errgo.Notef(err, "cannot do request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return unmarshalFormError(resp)
+}
+
+// formSchema fetches the login form schema from the given endpoint.
+func formSchema(client *http.Client, endpoint string) (environschema.Fields, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create request")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot do request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, unmarshalFormError(resp)
+	}
+	var sr params.SchemaResponse
+	if err := httprequest.UnmarshalJSONResponse(resp, &sr); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal login form schema")
+	}
+	if len(sr.Schema) == 0 {
+		return nil, errgo.New("login form schema has no fields")
+	}
+	return sr.Schema, nil
+}
+
+// unmarshalFormError returns the error held in the
+// given unsuccessful response.
+func unmarshalFormError(resp *http.Response) error {
+	var perr params.Error
+	if err := httprequest.UnmarshalJSONResponse(resp, &perr); err != nil {
+		return errgo.Notef(err, "cannot unmarshal error")
+	}
+	return errgo.NoteMask(&perr, "form login failed", errgo.Any)
+}
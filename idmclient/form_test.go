@@ -0,0 +1,144 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/juju/httprequest"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/environschema.v1"
+	"gopkg.in/juju/environschema.v1/form"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/params"
+)
+
+type formSuite struct{}
+
+var _ = gc.Suite(&formSuite{})
+
+var loginSchema = environschema.Fields{
+	"username": environschema.Attr{
+		Description: "username",
+		Type:        environschema.Tstring,
+		Mandatory:   true,
+	},
+	"password": environschema.Attr{
+		Description: "password",
+		Type:        environschema.Tstring,
+		Mandatory:   true,
+		Secret:      true,
+	},
+}
+
+func (*formSuite) TestFormLogin(c *gc.C) {
+	var posted map[string]interface{}
+	srv := newFormServer(func(w http.ResponseWriter, req *http.Request) {
+		var body params.LoginBody
+		err := json.NewDecoder(req.Body).Decode(&body)
+		c.Check(err, gc.IsNil)
+		posted = body.Form
+	})
+	defer srv.Close()
+	filler := &testFiller{
+		values: map[string]interface{}{
+			"username": "bob",
+			"password": "secret",
+		},
+	}
+	visit := idmclient.FormVisitWebPage(http.DefaultClient, filler)
+	err := visit(mustParseURL(srv.URL + "/visit"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(filler.form.Fields, jc.DeepEquals, loginSchema)
+	c.Assert(posted, jc.DeepEquals, map[string]interface{}{
+		"username": "bob",
+		"password": "secret",
+	})
+}
+
+func (*formSuite) TestFormLoginRejected(c *gc.C) {
+	srv := newFormServer(func(w http.ResponseWriter, req *http.Request) {
+		httprequest.WriteJSON(w, http.StatusUnauthorized, &params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "invalid credentials",
+		})
+	})
+	defer srv.Close()
+	filler := &testFiller{
+		values: map[string]interface{}{
+			"username": "bob",
+			"password": "wrong",
+		},
+	}
+	visit := idmclient.FormVisitWebPage(http.DefaultClient, filler)
+	err := visit(mustParseURL(srv.URL + "/visit"))
+	c.Assert(err, gc.ErrorMatches, `form login failed: invalid credentials`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
+
+func (*formSuite) TestFormLoginFillError(c *gc.C) {
+	srv := newFormServer(func(w http.ResponseWriter, req *http.Request) {
+		c.Errorf("unexpected form submission")
+	})
+	defer srv.Close()
+	filler := &testFiller{
+		err: errgo.New("interrupted"),
+	}
+	visit := idmclient.FormVisitWebPage(http.DefaultClient, filler)
+	err := visit(mustParseURL(srv.URL + "/visit"))
+	c.Assert(err, gc.ErrorMatches, `cannot fill login form: interrupted`)
+}
+
+func (*formSuite) TestFormLoginNotSupported(c *gc.C) {
+	m := idmclient.FormLoginMethod(http.DefaultClient, &testFiller{})
+	err := m.Login(mustParseURL("http://0.1.2.3/visit"), &params.LoginMethods{})
+	c.Assert(errgo.Cause(err), gc.Equals, idmclient.ErrLoginMethodNotSupported)
+}
+
+// newFormServer returns a server that advertises form login and
+// calls post when the completed form is submitted.
+func newFormServer(post http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	mux.HandleFunc("/visit", func(w http.ResponseWriter, req *http.Request) {
+		httprequest.WriteJSON(w, http.StatusOK, &params.LoginMethods{
+			Form: srv.URL + "/form",
+		})
+	})
+	mux.HandleFunc("/form", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			post(w, req)
+			return
+		}
+		httprequest.WriteJSON(w, http.StatusOK, &params.SchemaResponse{
+			Schema: loginSchema,
+		})
+	})
+	return srv
+}
+
+type testFiller struct {
+	values map[string]interface{}
+	err    error
+	form   form.Form
+}
+
+func (f *testFiller) Fill(form form.Form) (map[string]interface{}, error) {
+	f.form = form
+	return f.values, f.err
+}
+
+func mustParseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+
+	"github.com/juju/identity/params"
+)
+
+// InteractiveParams holds the parameters for an interactive login.
+type InteractiveParams struct {
+	// Open is used to open the login page, typically in a web
+	// browser. If it is nil, httpbakery.OpenWebBrowser is used.
+	Open func(u *url.URL) error
+
+	// Out, if non-nil, is used to print the address of the login
+	// page if it cannot be opened, or if Open is not set and
+	// NoBrowser is true.
+	Out io.Writer
+
+	// NoBrowser specifies that no attempt should be made to open
+	// the login page when Open is nil; its address is printed to
+	// Out instead.
+	NoBrowser bool
+}
+
+// InteractiveVisitWebPage returns a function that can be used with
+// httpbakery.Client.VisitWebPage to perform an interactive login. If
+// the identity server advertises an interactive login endpoint it is
+// visited, otherwise the visit URL itself is. The function returns
+// as soon as the user has been directed to the page, after which
+// httpbakery.Client waits on the wait endpoint for the login to
+// complete.
+func InteractiveVisitWebPage(client *http.Client, p InteractiveParams) func(u *url.URL) error {
+	m := InteractiveLoginMethod(p)
+	return func(u *url.URL) error {
+		lm, err := loginMethods(client, u)
+		if err != nil {
+			// Interactive login is the default, so servers are not
+			// obliged to return a list of login methods.
+			lm = &params.LoginMethods{}
+		}
+		return m.Login(u, lm)
+	}
+}
+
+// InteractiveLoginMethod returns a LoginMethod that performs an
+// interactive login as described by InteractiveVisitWebPage.
+// As interactive login is the default, it is always supported.
+func InteractiveLoginMethod(p InteractiveParams) LoginMethod {
+	return &interactiveLoginMethod{
+		p: p,
+	}
+}
+
+type interactiveLoginMethod struct {
+	p InteractiveParams
+}
+
+// Name implements LoginMethod.Name.
+func (m *interactiveLoginMethod) Name() string {
+	return "interactive"
+}
+
+// Login implements LoginMethod.Login.
+func (m *interactiveLoginMethod) Login(visitURL *url.URL, lm *params.LoginMethods) error {
+	u := visitURL
+	if lm.Interactive != "" {
+		iu, err := url.Parse(lm.Interactive)
+		if err != nil {
+			return errgo.Notef(err, "cannot parse interactive login URL")
+		}
+		u = visitURL.ResolveReference(iu)
+	}
+	open := m.p.Open
+	if open == nil && !m.p.NoBrowser {
+		open = httpbakery.OpenWebBrowser
+	}
+	if open != nil {
+		err := open(u)
+		if err == nil {
+			return nil
+		}
+		if m.p.Out == nil {
+			return errgo.Notef(err, "cannot open login page")
+		}
+		fmt.Fprintf(m.p.Out, "Cannot open a web browser: %v\n", err)
+	}
+	if m.p.Out == nil {
+		return errgo.New("cannot open login page: no browser or output available")
+	}
+	fmt.Fprintf(m.p.Out, "Please visit this web page to log in:\n%s\n", u)
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/juju/httprequest"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/params"
+)
+
+type interactiveSuite struct{}
+
+var _ = gc.Suite(&interactiveSuite{})
+
+func (*interactiveSuite) TestOpensInteractiveURL(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		httprequest.WriteJSON(w, http.StatusOK, &params.LoginMethods{
+			Interactive: "/interactive",
+		})
+	}))
+	defer srv.Close()
+	var opened *url.URL
+	visit := idmclient.InteractiveVisitWebPage(http.DefaultClient, idmclient.InteractiveParams{
+		Open: func(u *url.URL) error {
+			opened = u
+			return nil
+		},
+	})
+	err := visit(mustParseURL(srv.URL + "/visit"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(opened.String(), gc.Equals, srv.URL+"/interactive")
+}
+
+func (*interactiveSuite) TestOpensVisitURLWithoutLoginMethods(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer srv.Close()
+	var opened *url.URL
+	visit := idmclient.InteractiveVisitWebPage(http.DefaultClient, idmclient.InteractiveParams{
+		Open: func(u *url.URL) error {
+			opened = u
+			return nil
+		},
+	})
+	err := visit(mustParseURL(srv.URL + "/visit"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(opened.String(), gc.Equals, srv.URL+"/visit")
+}
+
+func (*interactiveSuite) TestPrintsURLWithoutBrowser(c *gc.C) {
+	var buf bytes.Buffer
+	m := idmclient.InteractiveLoginMethod(idmclient.InteractiveParams{
+		Out:       &buf,
+		NoBrowser: true,
+	})
+	err := m.Login(mustParseURL("http://example.com/visit"), &params.LoginMethods{
+		Interactive: "http://example.com/interactive",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, "Please visit this web page to log in:\nhttp://example.com/interactive\n")
+}
+
+func (*interactiveSuite) TestPrintsURLWhenOpenFails(c *gc.C) {
+	var buf bytes.Buffer
+	m := idmclient.InteractiveLoginMethod(idmclient.InteractiveParams{
+		Open: func(u *url.URL) error {
+			return errgo.New("no display")
+		},
+		Out: &buf,
+	})
+	err := m.Login(mustParseURL("http://example.com/visit"), &params.LoginMethods{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, "Cannot open a web browser: no display\nPlease visit this web page to log in:\nhttp://example.com/visit\n")
+}
+
+func (*interactiveSuite) TestOpenFailsWithoutOutput(c *gc.C) {
+	m := idmclient.InteractiveLoginMethod(idmclient.InteractiveParams{
+		Open: func(u *url.URL) error {
+			return errgo.New("no display")
+		},
+	})
+	err := m.Login(mustParseURL("http://example.com/visit"), &params.LoginMethods{})
+	c.Assert(err, gc.ErrorMatches, `cannot open login page: no display`)
+}
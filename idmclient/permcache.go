@@ -0,0 +1,185 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// GroupCache is the interface implemented by a cache of the groups of
+// users, as used by PermChecker. Implementations must be safe for
+// concurrent use. A cache that cannot read or write an entry should
+// behave as if the entry were not present.
+type GroupCache interface {
+	// Get returns the entry for the given user, or nil if there is
+	// none. The returned entry must not be modified.
+	Get(username string) *CacheEntry
+
+	// Set sets the entry for the given user. The cache should keep
+	// the entry for at least the given length of time and may
+	// discard it after that. The entry must not be modified after
+	// Set has been called.
+	Set(username string, e *CacheEntry, ttl time.Duration)
+
+	// Evict removes the entry for the given user, if any.
+	Evict(username string)
+
+	// EvictAll removes all entries.
+	EvictAll()
+
+	// Stats returns statistics about the cache.
+	Stats() GroupCacheStats
+}
+
+// CacheEntry holds a cache entry for the groups of a user.
+type CacheEntry struct {
+	// Groups holds the set of groups that the user is a member of,
+	// and Expires holds the time after which they are stale. If
+	// Groups is nil, no groups have been successfully fetched.
+	Groups  map[string]bool `json:"groups"`
+	Expires time.Time       `json:"expires"`
+
+	// Error holds the message of the error from the most recent
+	// lookup, if it failed, and ErrorExpires holds the time after
+	// which the error is no longer used.
+	Error        string    `json:"error,omitempty"`
+	ErrorExpires time.Time `json:"error-expires"`
+}
+
+// GroupCacheStats holds statistics about a GroupCache.
+type GroupCacheStats struct {
+	// Size holds the current number of entries.
+	Size int
+
+	// Evictions holds the number of entries evicted
+	// because the cache was full.
+	Evictions int64
+}
+
+// memCacheSweepInterval holds the minimum interval between
+// removals of expired entries from a MemGroupCache.
+const memCacheSweepInterval = time.Minute
+
+// MemGroupCache is an in-memory implementation of GroupCache. It is
+// used by PermChecker when no other cache is specified.
+type MemGroupCache struct {
+	maxEntries int
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// lru holds an *lruItem for every entry, most recently used first.
+	lru       *list.List
+	items     map[string]*list.Element
+	evictions int64
+	lastSweep time.Time
+}
+
+type lruItem struct {
+	username string
+	entry    *CacheEntry
+	deadline time.Time
+}
+
+// NewMemGroupCache returns a new in-memory cache. If maxEntries is
+// positive, the least recently used entries are evicted to keep the
+// number of entries within that bound.
+func NewMemGroupCache(maxEntries int) *MemGroupCache {
+	return &MemGroupCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get implements GroupCache.Get.
+func (c *MemGroupCache) Get(username string) *CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[username]
+	if !ok {
+		return nil
+	}
+	item := elem.Value.(*lruItem)
+	if !time.Now().Before(item.deadline) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return item.entry
+}
+
+// Set implements GroupCache.Set.
+func (c *MemGroupCache) Set(username string, e *CacheEntry, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if elem, ok := c.items[username]; ok {
+		item := elem.Value.(*lruItem)
+		item.entry = e
+		item.deadline = now.Add(ttl)
+		c.lru.MoveToFront(elem)
+	} else {
+		c.items[username] = c.lru.PushFront(&lruItem{
+			username: username,
+			entry:    e,
+			deadline: now.Add(ttl),
+		})
+	}
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+	if now.Sub(c.lastSweep) >= memCacheSweepInterval {
+		c.sweep(now)
+	}
+}
+
+// Evict implements GroupCache.Evict.
+func (c *MemGroupCache) Evict(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[username]; ok {
+		c.remove(elem)
+	}
+}
+
+// EvictAll implements GroupCache.EvictAll.
+func (c *MemGroupCache) EvictAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// Stats implements GroupCache.Stats.
+func (c *MemGroupCache) Stats() GroupCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return GroupCacheStats{
+		Size:      c.lru.Len(),
+		Evictions: c.evictions,
+	}
+}
+
+// sweep removes all the entries that have passed their deadline, so
+// that the cache does not grow without bound. It must be called with
+// c.mu held.
+func (c *MemGroupCache) sweep(now time.Time) {
+	var next *list.Element
+	for elem := c.lru.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		if !now.Before(elem.Value.(*lruItem).deadline) {
+			c.remove(elem)
+		}
+	}
+	c.lastSweep = now
+}
+
+func (c *MemGroupCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.items, elem.Value.(*lruItem).username)
+}
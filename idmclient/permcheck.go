@@ -4,9 +4,12 @@
 package idmclient
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/juju/utils/cache"
 	"gopkg.in/errgo.v1"
 
 	"github.com/juju/identity/params"
@@ -14,18 +17,137 @@ import (
 
 // PermChecker provides a way to query ACLs using the identity client.
 type PermChecker struct {
-	cache  *cache.Cache
-	client *Client
+	p PermCheckerParams
+
+	// now returns the current time. It is
+	// replaced in tests.
+	now func() time.Time
+
+	cache GroupCache
+
+	// mu guards the fields below it.
+	mu       sync.Mutex
+	inflight map[string]*groupsCall
+	stats    PermCheckerStats
+}
+
+// PermCheckerParams holds the parameters for
+// NewPermCheckerWithParams.
+type PermCheckerParams struct {
+	// Client holds the identity client used to
+	// look up group membership.
+	Client *Client
+
+	// CacheTime holds the length of time for which
+	// the groups of a user are cached.
+	CacheTime time.Duration
+
+	// NotFoundCacheTime holds the length of time for which the
+	// identity server's response is cached when a user is not
+	// found. If it is zero, such responses are not cached, so a
+	// newly created user is seen immediately.
+	NotFoundCacheTime time.Duration
+
+	// ErrorCacheTime holds the length of time for which an error
+	// looking up the groups of a user is cached. If it is zero,
+	// errors are not cached.
+	ErrorCacheTime time.Duration
+
+	// Cache holds the cache used to store the groups of users. It
+	// may be shared between PermCheckers, including those in other
+	// processes. If it is nil, an in-memory cache is used.
+	Cache GroupCache
+
+	// MaxCacheEntries, if positive, holds the maximum number of
+	// users whose groups are cached when Cache is nil. When the
+	// cache is full, the least recently used entry is evicted.
+	MaxCacheEntries int
+
+	// FetchConcurrency holds the maximum number of concurrent
+	// group lookups made by AllowMany. If it is zero,
+	// a default of 10 is used.
+	FetchConcurrency int
+
+	// StaleWhileRevalidate, if non-zero, holds the length of time
+	// after a cache entry has expired during which it will still
+	// be used, while a fresh value is fetched in the background.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError, if non-zero, holds the length of time after a
+	// cache entry has expired during which it will still be used
+	// if a fresh value cannot be fetched from the identity server.
+	StaleIfError time.Duration
+}
+
+// PermCheckerStats holds statistics about the group lookups
+// made by a PermChecker.
+type PermCheckerStats struct {
+	// Hits holds the number of group lookups
+	// satisfied from the cache.
+	Hits int64
+
+	// Misses holds the number of group lookups
+	// not satisfied from the cache.
+	Misses int64
+
+	// Evictions and Size hold the statistics
+	// reported by the cache. See GroupCacheStats.
+	Evictions int64
+	Size      int
+
+	// Fetches holds the number of group lookups
+	// made to the identity server.
+	Fetches int64
+
+	// CoalescedFetches holds the number of group lookups that were
+	// saved by waiting for a lookup of the same user that was
+	// already in progress.
+	CoalescedFetches int64
+}
+
+// groupsCall represents a group lookup that is in progress.
+type groupsCall struct {
+	// done is closed when the lookup has completed.
+	done chan struct{}
+
+	groups map[string]bool
+	err    error
+
+	// waiters holds the number of callers waiting for the result
+	// of the lookup, and cancel cancels the lookup. stale records
+	// that the user's cache entry was evicted while the lookup was
+	// in progress, so that its result may be out of date and must
+	// not be cached. They are guarded by PermChecker.mu.
+	waiters int
+	cancel  func()
+	stale   bool
 }
 
 // NewPermChecker returns a permission checker
 // that uses the given identity client to check permissions.
 //
-// It will cache results for at most cacheTime.
+// It will cache results, including those for users that are
+// not found, for at most cacheTime.
 func NewPermChecker(c *Client, cacheTime time.Duration) *PermChecker {
+	return NewPermCheckerWithParams(PermCheckerParams{
+		Client:            c,
+		CacheTime:         cacheTime,
+		NotFoundCacheTime: cacheTime,
+	})
+}
+
+// NewPermCheckerWithParams returns a permission checker
+// configured with the given parameters.
+func NewPermCheckerWithParams(p PermCheckerParams) *PermChecker {
+	cache := p.Cache
+	if cache == nil {
+		cache = NewMemGroupCache(p.MaxCacheEntries)
+	}
 	return &PermChecker{
-		cache:  cache.New(cacheTime),
-		client: c,
+		p:        p,
+		now:      time.Now,
+		cache:    cache,
+		inflight: make(map[string]*groupsCall),
 	}
 }
 
@@ -33,31 +155,24 @@ func NewPermChecker(c *Client, cacheTime time.Duration) *PermChecker {
 // name. If the user does not exist and the ACL does not allow username
 // or everyone, it will return (false, nil).
 func (c *PermChecker) Allow(username string, acl []string) (bool, error) {
+	return c.AllowContext(context.Background(), username, acl)
+}
+
+// AllowContext is like Allow except that any request to the identity
+// server is made with the given context.
+func (c *PermChecker) AllowContext(ctx context.Context, username string, acl []string) (bool, error) {
 	if len(acl) == 0 {
 		return false, nil
 	}
 	for _, name := range acl {
-		if name == "everyone" || name == username {
+		if name == params.Everyone || name == username {
 			return true, nil
 		}
 	}
-	groups0, err := c.cache.Get(username, func() (interface{}, error) {
-		groups, err := c.client.UserGroups(&params.UserGroupsRequest{
-			Username: params.Username(username),
-		})
-		if err != nil && errgo.Cause(err) != params.ErrNotFound {
-			return nil, errgo.Mask(err)
-		}
-		groupMap := make(map[string]bool)
-		for _, g := range groups {
-			groupMap[g] = true
-		}
-		return groupMap, nil
-	})
+	groups, err := c.groups(ctx, username)
 	if err != nil {
 		return false, errgo.Notef(err, "cannot fetch groups")
 	}
-	groups := groups0.(map[string]bool)
 	for _, a := range acl {
 		if groups[a] {
 			return true, nil
@@ -66,12 +181,475 @@ func (c *PermChecker) Allow(username string, acl []string) (bool, error) {
 	return false, nil
 }
 
-// CacheEvict evicts username from the cache.
+// MatchReason describes why an ACL entry matched a user.
+type MatchReason int
+
+const (
+	// MatchEveryone indicates that the entry was "everyone".
+	MatchEveryone MatchReason = iota + 1
+
+	// MatchUser indicates that the entry was the user's name.
+	MatchUser
+
+	// MatchGroup indicates that the entry was a group
+	// that the user is a member of.
+	MatchGroup
+)
+
+var matchReasonNames = map[MatchReason]string{
+	MatchEveryone: "everyone",
+	MatchUser:     "user",
+	MatchGroup:    "group",
+}
+
+// String implements fmt.Stringer.
+func (r MatchReason) String() string {
+	if name, ok := matchReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("MatchReason(%d)", int(r))
+}
+
+// ACLMatch holds an ACL entry that matched a user.
+type ACLMatch struct {
+	// Entry holds the matching entry.
+	Entry string
+
+	// Reason holds why the entry matched.
+	Reason MatchReason
+}
+
+// ACLMatches returns all the entries in the given ACL that admit the
+// user with the given name, in the order they appear in acl, so that
+// callers can tell why Allow granted access. If no entries match, it
+// returns an empty slice.
+func (c *PermChecker) ACLMatches(username string, acl []string) ([]ACLMatch, error) {
+	return c.ACLMatchesContext(context.Background(), username, acl)
+}
+
+// ACLMatchesContext is like ACLMatches except that any request to the
+// identity server is made with the given context.
+func (c *PermChecker) ACLMatchesContext(ctx context.Context, username string, acl []string) ([]ACLMatch, error) {
+	matches := make([]ACLMatch, 0, len(acl))
+	var groups map[string]bool
+	for _, name := range acl {
+		switch name {
+		case params.Everyone:
+			matches = append(matches, ACLMatch{name, MatchEveryone})
+			continue
+		case username:
+			matches = append(matches, ACLMatch{name, MatchUser})
+			continue
+		}
+		if groups == nil {
+			var err error
+			groups, err = c.groups(ctx, username)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot fetch groups")
+			}
+		}
+		if groups[name] {
+			matches = append(matches, ACLMatch{name, MatchGroup})
+		}
+	}
+	return matches, nil
+}
+
+// defaultFetchConcurrency holds the default value
+// of PermCheckerParams.FetchConcurrency.
+const defaultFetchConcurrency = 10
+
+// AllowResult holds the result of checking
+// a single user with AllowMany.
+type AllowResult struct {
+	// Username holds the name of the user.
+	Username string
+
+	// Allowed holds whether the ACL admits the user.
+	Allowed bool
+
+	// Err holds any error encountered checking the user.
+	Err error
+}
+
+// AllowMany reports whether the given ACL admits each of the given
+// users, as determined by Allow. The groups of users that are not
+// cached are fetched concurrently. The results are returned in the
+// same order as usernames.
+func (c *PermChecker) AllowMany(usernames []string, acl []string) []AllowResult {
+	return c.AllowManyContext(context.Background(), usernames, acl)
+}
+
+// AllowManyContext is like AllowMany except that any requests to the
+// identity server are made with the given context.
+func (c *PermChecker) AllowManyContext(ctx context.Context, usernames []string, acl []string) []AllowResult {
+	results := make([]AllowResult, len(usernames))
+	n := c.p.FetchConcurrency
+	if n <= 0 {
+		n = defaultFetchConcurrency
+	}
+	if n > len(usernames) {
+		n = len(usernames)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				ok, err := c.AllowContext(ctx, usernames[i], acl)
+				results[i] = AllowResult{
+					Username: usernames[i],
+					Allowed:  ok,
+					Err:      err,
+				}
+			}
+		}()
+	}
+	for i := range usernames {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// AllowACL reports whether the given ACL admits the user with the
+// given name. See params.ACL for a description of how ACLs are
+// evaluated. The user's groups are only fetched if they are needed to
+// decide the result.
+func (c *PermChecker) AllowACL(username string, acl params.ACL) (bool, error) {
+	return c.AllowACLContext(context.Background(), username, acl)
+}
+
+// AllowACLContext is like AllowACL except that any request to the
+// identity server is made with the given context.
+func (c *PermChecker) AllowACLContext(ctx context.Context, username string, acl params.ACL) (bool, error) {
+	m := &aclMatcher{
+		username: username,
+		fetchGroups: func() (map[string]bool, error) {
+			return c.groups(ctx, username)
+		},
+	}
+	// Deny entries take precedence, so check them first.
+	for _, deny := range []bool{true, false} {
+		for _, e := range acl {
+			if e.Deny != deny {
+				continue
+			}
+			ok, err := m.matchEntry(e)
+			if err != nil {
+				return false, errgo.Notef(err, "cannot fetch groups")
+			}
+			if ok {
+				return !deny, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// aclMatcher matches ACL entries against a user,
+// fetching the user's groups only when required.
+type aclMatcher struct {
+	username    string
+	fetchGroups func() (map[string]bool, error)
+	groups      map[string]bool
+}
+
+// matchEntry reports whether all the terms in e match the user.
+func (m *aclMatcher) matchEntry(e params.ACLEntry) (bool, error) {
+	if len(e.Terms) == 0 {
+		return false, nil
+	}
+	// Check the terms that don't need the user's groups
+	// first, to avoid fetching them unnecessarily.
+	var groupTerms []string
+	for _, t := range e.Terms {
+		ok, needGroups := m.matchName(t)
+		if needGroups {
+			groupTerms = append(groupTerms, t)
+		} else if !ok {
+			return false, nil
+		}
+	}
+	if len(groupTerms) == 0 {
+		return true, nil
+	}
+	if m.groups == nil {
+		groups, err := m.fetchGroups()
+		if err != nil {
+			return false, errgo.Mask(err, errgo.Any)
+		}
+		m.groups = groups
+	}
+	for _, t := range groupTerms {
+		if !m.groups[t] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchName reports whether the term matches the user without
+// reference to their groups. If it does not, needGroups reports whether
+// the term might still match one of the user's groups.
+func (m *aclMatcher) matchName(t string) (ok, needGroups bool) {
+	switch {
+	case t == params.Everyone || t == m.username:
+		return true, false
+	case strings.HasPrefix(t, "*@"):
+		return strings.HasSuffix(m.username, t[1:]), false
+	}
+	return false, true
+}
+
+// Stats returns statistics about the group lookups made by c.
+func (c *PermChecker) Stats() PermCheckerStats {
+	c.mu.Lock()
+	stats := c.stats
+	c.mu.Unlock()
+	cacheStats := c.cache.Stats()
+	stats.Evictions = cacheStats.Evictions
+	stats.Size = cacheStats.Size
+	return stats
+}
+
+// groups returns the groups of the given user, using the
+// cache when possible.
+func (c *PermChecker) groups(ctx context.Context, username string) (map[string]bool, error) {
+	now := c.now()
+	e := c.cache.Get(username)
+	groups, hit, err := e.lookup(now, c.p)
+	c.mu.Lock()
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+	c.mu.Unlock()
+	if hit {
+		if e.needsRefresh(now) {
+			c.refresh(username)
+		}
+		return groups, err
+	}
+	groups, err = c.fetchGroups(ctx, username)
+	if err == nil {
+		return groups, nil
+	}
+	if e != nil && e.usableIfError(now, c.p.StaleIfError) {
+		return e.Groups, nil
+	}
+	return nil, errgo.Mask(err, errgo.Any)
+}
+
+// lookup returns the result held in the entry at the given time,
+// and reports whether the entry could be used. It may be
+// called on a nil entry.
+func (e *CacheEntry) lookup(now time.Time, p PermCheckerParams) (map[string]bool, bool, error) {
+	switch {
+	case e == nil:
+		return nil, false, nil
+	case e.Error != "" && now.Before(e.ErrorExpires):
+		if e.usableIfError(now, p.StaleIfError) {
+			return e.Groups, true, nil
+		}
+		return nil, true, errgo.New(e.Error)
+	case e.Groups == nil:
+		return nil, false, nil
+	case now.Before(e.Expires):
+		return e.Groups, true, nil
+	case now.Before(e.Expires.Add(p.StaleWhileRevalidate)):
+		return e.Groups, true, nil
+	}
+	return nil, false, nil
+}
+
+// needsRefresh reports whether the entry's groups have
+// expired, so that they should be refreshed in the background.
+func (e *CacheEntry) needsRefresh(now time.Time) bool {
+	return e.Groups != nil && !now.Before(e.Expires) && (e.Error == "" || !now.Before(e.ErrorExpires))
+}
+
+// usableIfError reports whether the entry's groups may be used
+// at the given time when they cannot be refreshed.
+func (e *CacheEntry) usableIfError(now time.Time, staleIfError time.Duration) bool {
+	return e.Groups != nil && now.Before(e.Expires.Add(staleIfError))
+}
+
+// refresh starts fetching the groups of the given user in the
+// background, unless a fetch is already in progress.
+func (c *PermChecker) refresh(username string) {
+	c.mu.Lock()
+	_, ok := c.inflight[username]
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+	go c.fetchGroups(context.Background(), username)
+}
+
+// fetchGroups fetches the groups of the given user from the identity
+// server and stores them in the cache. Concurrent calls for the same
+// user share a single lookup, and all callers receive its result.
+// The lookup is not bound to the context of any one caller: each
+// caller stops waiting when its own context is done, and the lookup
+// is cancelled only when no callers are left waiting for it.
+func (c *PermChecker) fetchGroups(ctx context.Context, username string) (map[string]bool, error) {
+	c.mu.Lock()
+	call, ok := c.inflight[username]
+	if ok {
+		c.stats.CoalescedFetches++
+	} else {
+		fetchCtx, cancel := context.WithCancel(context.Background())
+		call = &groupsCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		c.inflight[username] = call
+		c.stats.Fetches++
+		go c.doFetchGroups(fetchCtx, username, call)
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.groups, call.err
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call.waiters--
+	if call.waiters == 0 {
+		// Nobody is interested in the result any more, so
+		// abandon the lookup. Later callers start a new one.
+		call.cancel()
+		if c.inflight[username] == call {
+			delete(c.inflight, username)
+		}
+	}
+	return nil, ctx.Err()
+}
+
+// doFetchGroups performs the lookup represented by call,
+// which is cancelled when ctx is done.
+func (c *PermChecker) doFetchGroups(ctx context.Context, username string, call *groupsCall) {
+	groups, notFound, err := c.userGroups(ctx, username)
+	call.groups, call.err = groups, err
+
+	// The result is stored with c.mu held so that it cannot
+	// race with an eviction.
+	c.mu.Lock()
+	if !call.stale && (err == nil || ctx.Err() == nil) {
+		// Don't cache errors caused by the lookup
+		// being abandoned.
+		c.store(username, groups, notFound, err)
+	}
+	if c.inflight[username] == call {
+		delete(c.inflight, username)
+	}
+	c.mu.Unlock()
+	call.cancel()
+	close(call.done)
+}
+
+// store stores the result of looking up the groups of the given user
+// in the cache. It must be called with c.mu held.
+func (c *PermChecker) store(username string, groups map[string]bool, notFound bool, err error) {
+	now := c.now()
+	var e *CacheEntry
+	switch {
+	case err != nil:
+		if c.p.ErrorCacheTime <= 0 {
+			return
+		}
+		// Keep any existing groups so that they can be used
+		// if stale. Entries are never modified in place, as
+		// they may be in use elsewhere.
+		e = new(CacheEntry)
+		if old := c.cache.Get(username); old != nil {
+			*e = *old
+		}
+		e.Error = err.Error()
+		e.ErrorExpires = now.Add(c.p.ErrorCacheTime)
+	case notFound && c.p.NotFoundCacheTime <= 0:
+		c.cache.Evict(username)
+		return
+	default:
+		ttl := c.p.CacheTime
+		if notFound {
+			ttl = c.p.NotFoundCacheTime
+		}
+		e = &CacheEntry{
+			Groups:  groups,
+			Expires: now.Add(ttl),
+		}
+	}
+	// Keep the entry for as long as any part of it may be used.
+	deadline := e.Expires.Add(c.retention())
+	if e.ErrorExpires.After(deadline) {
+		deadline = e.ErrorExpires
+	}
+	if ttl := deadline.Sub(now); ttl > 0 {
+		c.cache.Set(username, e, ttl)
+	} else {
+		c.cache.Evict(username)
+	}
+}
+
+// retention returns the length of time after expiry
+// that a cache entry may still be used.
+func (c *PermChecker) retention() time.Duration {
+	if c.p.StaleIfError > c.p.StaleWhileRevalidate {
+		return c.p.StaleIfError
+	}
+	return c.p.StaleWhileRevalidate
+}
+
+// userGroups returns the groups of the given user as a set. If the
+// user does not exist, it returns an empty set and reports that the
+// user was not found.
+func (c *PermChecker) userGroups(ctx context.Context, username string) (groups map[string]bool, notFound bool, err error) {
+	groupList, err := c.p.Client.UserGroupsContext(ctx, &params.UserGroupsRequest{
+		Username: params.Username(username),
+	})
+	if err != nil {
+		if errgo.Cause(err) != params.ErrNotFound {
+			return nil, false, errgo.Mask(err)
+		}
+		notFound = true
+	}
+	groups = make(map[string]bool)
+	for _, g := range groupList {
+		groups[g] = true
+	}
+	return groups, notFound, nil
+}
+
+// CacheEvict evicts username from the cache. The result of any lookup
+// of the user's groups that is already in progress will not be cached,
+// and later lookups do not share it.
 func (c *PermChecker) CacheEvict(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call := c.inflight[username]; call != nil {
+		call.stale = true
+		delete(c.inflight, username)
+	}
 	c.cache.Evict(username)
 }
 
-// CacheEvictAll evicts everything from the cache.
+// CacheEvictAll evicts everything from the cache. As with CacheEvict,
+// the results of lookups already in progress will not be cached.
 func (c *PermChecker) CacheEvictAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for username, call := range c.inflight {
+		call.stale = true
+		delete(c.inflight, username)
+	}
 	c.cache.EvictAll()
 }
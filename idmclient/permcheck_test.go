@@ -1,12 +1,22 @@
 package idmclient_test
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"time"
 
+	"github.com/juju/httprequest"
+	jc "github.com/juju/testing/checkers"
+	"github.com/julienschmidt/httprouter"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
 
 	"github.com/juju/identity/idmclient"
 	"github.com/juju/identity/idmtest"
+	"github.com/juju/identity/params"
 )
 
 type permCheckerSuite struct {
@@ -59,3 +69,738 @@ func (s *permCheckerSuite) TestPermChecker(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(ok, gc.Equals, true)
 }
+
+func (s *permCheckerSuite) TestConcurrentFetchesCoalesced(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles")
+	srv.block()
+
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+	const n = 10
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			ok, err := pc.Allow("bob", []string{"beatles"})
+			if err == nil && !ok {
+				err = errgo.New("not allowed")
+			}
+			results <- err
+		}()
+	}
+	// Wait for all the callers to be waiting for
+	// the first one's lookup.
+	waitFor(c, func() bool {
+		return pc.Stats().CoalescedFetches == n-1
+	})
+	c.Assert(pc.Stats(), jc.DeepEquals, idmclient.PermCheckerStats{
+		Misses:           n,
+		Fetches:          1,
+		CoalescedFetches: n - 1,
+	})
+	srv.unblock()
+	for i := 0; i < n; i++ {
+		c.Assert(<-results, gc.IsNil)
+	}
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+}
+
+func (s *permCheckerSuite) TestConcurrentFetchErrorShared(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.block()
+
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+	const n = 5
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := pc.Allow("bob", []string{"beatles"})
+			results <- err
+		}()
+	}
+	waitFor(c, func() bool {
+		return pc.Stats().CoalescedFetches == n-1
+	})
+	srv.setError(errgo.New("identity is down"))
+	srv.unblock()
+	for i := 0; i < n; i++ {
+		c.Assert(<-results, gc.ErrorMatches, `cannot fetch groups: .*identity is down`)
+	}
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+}
+
+func (s *permCheckerSuite) TestCoalescedFetchOutlivesCancelledCaller(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles")
+	srv.block()
+
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result0 := make(chan error, 1)
+	go func() {
+		_, err := pc.AllowContext(ctx, "bob", []string{"beatles"})
+		result0 <- err
+	}()
+	waitFor(c, func() bool {
+		return pc.Stats().Fetches == 1
+	})
+	result1 := make(chan error, 1)
+	go func() {
+		ok, err := pc.Allow("bob", []string{"beatles"})
+		if err == nil && !ok {
+			err = errgo.New("not allowed")
+		}
+		result1 <- err
+	}()
+	waitFor(c, func() bool {
+		return pc.Stats().CoalescedFetches == 1
+	})
+
+	// The first caller gives up, but the lookup continues
+	// on behalf of the second.
+	cancel()
+	c.Assert(<-result0, gc.ErrorMatches, `cannot fetch groups: context canceled`)
+	srv.unblock()
+	c.Assert(<-result1, gc.IsNil)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+}
+
+func (s *permCheckerSuite) TestEvictDuringFetch(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles")
+	srv.block()
+
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+	result := make(chan bool, 1)
+	go func() {
+		ok, err := pc.Allow("bob", []string{"beatles"})
+		c.Check(err, gc.IsNil)
+		result <- ok
+	}()
+	waitFor(c, func() bool {
+		return srv.requestCount("bob") == 1
+	})
+
+	// A change to bob is reported while his groups are being
+	// fetched, so the result of the fetch may be out of date.
+	pc.CacheEvict("bob")
+	srv.unblock()
+	c.Assert(<-result, gc.Equals, true)
+	srv.setGroups("bob", "stones")
+
+	// The result of the fetch that was in progress was not
+	// cached, so the new groups are fetched.
+	ok, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 2)
+}
+
+// waitFor waits for f to return true, failing
+// the test if that takes too long.
+func waitFor(c *gc.C, f func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			c.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// groupsServer is a minimal identity server that serves
+// only the user groups endpoint.
+type groupsServer struct {
+	*httptest.Server
+
+	// mu guards the fields below it.
+	mu       sync.Mutex
+	groups   map[string][]string
+	err      error
+	userErrs map[string]error
+	requests map[string]int
+	gate     chan struct{}
+}
+
+func newGroupsServer() *groupsServer {
+	srv := &groupsServer{
+		groups:   make(map[string][]string),
+		userErrs: make(map[string]error),
+		requests: make(map[string]int),
+	}
+	router := httprouter.New()
+	router.GET("/v1/u/:username/groups", srv.serveGroups)
+	srv.Server = httptest.NewServer(router)
+	return srv
+}
+
+func (srv *groupsServer) serveGroups(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	username := p.ByName("username")
+	srv.mu.Lock()
+	srv.requests[username]++
+	gate := srv.gate
+	srv.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	srv.mu.Lock()
+	groups, ok := srv.groups[username]
+	err := srv.err
+	if userErr := srv.userErrs[username]; userErr != nil {
+		err = userErr
+	}
+	srv.mu.Unlock()
+	switch {
+	case err != nil:
+		httprequest.WriteJSON(w, http.StatusInternalServerError, &params.Error{
+			Message: err.Error(),
+		})
+	case !ok:
+		httprequest.WriteJSON(w, http.StatusNotFound, &params.Error{
+			Code:    params.ErrNotFound,
+			Message: "user not found",
+		})
+	default:
+		httprequest.WriteJSON(w, http.StatusOK, groups)
+	}
+}
+
+// client returns an identity client that talks to the server.
+func (srv *groupsServer) client() *idmclient.Client {
+	return idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL,
+		Client:  httpbakery.NewClient(),
+	})
+}
+
+// setGroups sets the groups of the given user, adding
+// the user if necessary.
+func (srv *groupsServer) setGroups(username string, groups ...string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.groups[username] = groups
+}
+
+// setError causes all subsequent requests to fail with
+// the given error, or succeed again if err is nil.
+func (srv *groupsServer) setError(err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.err = err
+}
+
+// setUserError causes subsequent requests for the given user
+// to fail with the given error, or succeed again if err is nil.
+func (srv *groupsServer) setUserError(username string, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.userErrs[username] = err
+}
+
+// block causes requests to block until unblock is called.
+func (srv *groupsServer) block() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.gate = make(chan struct{})
+}
+
+// unblock releases any blocked requests.
+func (srv *groupsServer) unblock() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	close(srv.gate)
+	srv.gate = nil
+}
+
+// requestCount returns the number of requests made
+// for the groups of the given user.
+func (srv *groupsServer) requestCount(username string) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.requests[username]
+}
+
+func (s *permCheckerSuite) TestStaleWhileRevalidate(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles")
+	clock := newTestClock()
+	pc := idmclient.NewPermCheckerWithParams(idmclient.PermCheckerParams{
+		Client:               srv.client(),
+		CacheTime:            time.Minute,
+		StaleWhileRevalidate: time.Minute,
+	})
+	idmclient.SetPermCheckerNow(pc, clock.now)
+
+	ok, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+
+	// After the entry has expired, the stale value is
+	// returned while it is refreshed in the background.
+	srv.setGroups("bob")
+	clock.advance(90 * time.Second)
+	ok, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	waitFor(c, func() bool {
+		ok, err := pc.Allow("bob", []string{"beatles"})
+		c.Assert(err, gc.IsNil)
+		return !ok
+	})
+	c.Assert(srv.requestCount("bob"), gc.Equals, 2)
+
+	// Once the stale period has passed, the value is
+	// fetched synchronously.
+	srv.setGroups("bob", "beatles")
+	clock.advance(3 * time.Minute)
+	ok, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 3)
+}
+
+func (s *permCheckerSuite) TestStaleIfError(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles")
+	clock := newTestClock()
+	pc := idmclient.NewPermCheckerWithParams(idmclient.PermCheckerParams{
+		Client:       srv.client(),
+		CacheTime:    time.Minute,
+		StaleIfError: 5 * time.Minute,
+	})
+	idmclient.SetPermCheckerNow(pc, clock.now)
+
+	ok, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	// While the identity server is down, the last known
+	// groups are used until the grace period runs out.
+	srv.setError(errgo.New("identity is down"))
+	clock.advance(2 * time.Minute)
+	ok, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 2)
+
+	clock.advance(5 * time.Minute)
+	_, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.ErrorMatches, `cannot fetch groups: .*identity is down`)
+}
+
+func (s *permCheckerSuite) TestNoStaleResultsByDefault(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles")
+	clock := newTestClock()
+	pc := idmclient.NewPermChecker(srv.client(), time.Minute)
+	idmclient.SetPermCheckerNow(pc, clock.now)
+
+	ok, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	srv.setError(errgo.New("identity is down"))
+	clock.advance(2 * time.Minute)
+	_, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.ErrorMatches, `cannot fetch groups: .*identity is down`)
+}
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{
+		t: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (clock *testClock) now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.t
+}
+
+func (clock *testClock) advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.t = clock.t.Add(d)
+}
+
+func (s *permCheckerSuite) TestNotFoundNotCached(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("alice")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("alice"),
+	})
+	pc := idmclient.NewPermCheckerWithParams(idmclient.PermCheckerParams{
+		Client:    client,
+		CacheTime: time.Hour,
+	})
+	ok, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+
+	// The new user is seen without needing to evict the cache.
+	srv.AddUser("bob", "beatles")
+	ok, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *permCheckerSuite) TestNotFoundCacheTime(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	clock := newTestClock()
+	pc := idmclient.NewPermCheckerWithParams(idmclient.PermCheckerParams{
+		Client:            srv.client(),
+		CacheTime:         time.Hour,
+		NotFoundCacheTime: time.Minute,
+	})
+	idmclient.SetPermCheckerNow(pc, clock.now)
+
+	ok, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+
+	srv.setGroups("bob", "beatles")
+	ok, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+
+	clock.advance(2 * time.Minute)
+	ok, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 2)
+
+	// Positive results are still cached for CacheTime.
+	srv.setGroups("bob")
+	clock.advance(2 * time.Minute)
+	ok, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 2)
+}
+
+func (s *permCheckerSuite) TestErrorCacheTime(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles")
+	srv.setError(errgo.New("identity is down"))
+	clock := newTestClock()
+	pc := idmclient.NewPermCheckerWithParams(idmclient.PermCheckerParams{
+		Client:         srv.client(),
+		CacheTime:      time.Hour,
+		ErrorCacheTime: 10 * time.Second,
+	})
+	idmclient.SetPermCheckerNow(pc, clock.now)
+
+	_, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.ErrorMatches, `cannot fetch groups: .*identity is down`)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+
+	// The error is cached.
+	srv.setError(nil)
+	_, err = pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.ErrorMatches, `cannot fetch groups: .*identity is down`)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+
+	clock.advance(20 * time.Second)
+	ok, err := pc.Allow("bob", []string{"beatles"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 2)
+}
+
+func (s *permCheckerSuite) TestMaxCacheEntries(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("alice", "beatles")
+	srv.setGroups("bob", "beatles")
+	srv.setGroups("charlie", "beatles")
+	pc := idmclient.NewPermCheckerWithParams(idmclient.PermCheckerParams{
+		Client:          srv.client(),
+		CacheTime:       time.Hour,
+		MaxCacheEntries: 2,
+	})
+	allow := func(username string) {
+		ok, err := pc.Allow(username, []string{"beatles"})
+		c.Assert(err, gc.IsNil)
+		c.Assert(ok, gc.Equals, true)
+	}
+	allow("alice")
+	allow("bob")
+	// Use alice so that bob becomes the least recently used entry.
+	allow("alice")
+	c.Assert(pc.Stats(), jc.DeepEquals, idmclient.PermCheckerStats{
+		Hits:    1,
+		Misses:  2,
+		Fetches: 2,
+		Size:    2,
+	})
+
+	// Adding charlie evicts bob.
+	allow("charlie")
+	c.Assert(pc.Stats(), jc.DeepEquals, idmclient.PermCheckerStats{
+		Hits:      1,
+		Misses:    3,
+		Fetches:   3,
+		Evictions: 1,
+		Size:      2,
+	})
+	allow("alice")
+	allow("charlie")
+	c.Assert(srv.requestCount("alice"), gc.Equals, 1)
+	c.Assert(srv.requestCount("charlie"), gc.Equals, 1)
+
+	allow("bob")
+	c.Assert(srv.requestCount("bob"), gc.Equals, 2)
+	c.Assert(pc.Stats(), jc.DeepEquals, idmclient.PermCheckerStats{
+		Hits:      3,
+		Misses:    4,
+		Fetches:   4,
+		Evictions: 2,
+		Size:      2,
+	})
+}
+
+var allowACLTests = []struct {
+	about       string
+	username    string
+	acl         string
+	expect      bool
+	expectFetch bool
+}{{
+	about:    "empty ACL",
+	username: "bob",
+	acl:      "",
+	expect:   false,
+}, {
+	about:    "everyone",
+	username: "bob",
+	acl:      "everyone",
+	expect:   true,
+}, {
+	about:    "username",
+	username: "bob",
+	acl:      "alice, bob",
+	expect:   true,
+}, {
+	about:       "group",
+	username:    "bob",
+	acl:         "beatles",
+	expect:      true,
+	expectFetch: true,
+}, {
+	about:       "not in group",
+	username:    "bob",
+	acl:         "stones",
+	expect:      false,
+	expectFetch: true,
+}, {
+	about:       "intersection",
+	username:    "bob",
+	acl:         "beatles AND bass",
+	expect:      true,
+	expectFetch: true,
+}, {
+	about:       "intersection not matched",
+	username:    "bob",
+	acl:         "beatles AND drums",
+	expect:      false,
+	expectFetch: true,
+}, {
+	about:    "intersection with name avoids fetch",
+	username: "bob",
+	acl:      "alice AND beatles",
+	expect:   false,
+}, {
+	about:    "wildcard domain",
+	username: "bob@external",
+	acl:      "*@external",
+	expect:   true,
+}, {
+	about:    "wildcard domain not matched",
+	username: "bob@internal",
+	acl:      "*@external",
+	expect:   false,
+}, {
+	about:       "deny takes precedence",
+	username:    "bob",
+	acl:         "everyone, !beatles",
+	expect:      false,
+	expectFetch: true,
+}, {
+	about:       "deny not matched",
+	username:    "bob",
+	acl:         "everyone, !stones",
+	expect:      true,
+	expectFetch: true,
+}, {
+	about:    "deny by wildcard",
+	username: "bob@external",
+	acl:      "!*@external, bob@external",
+	expect:   false,
+}, {
+	about:       "deny intersection",
+	username:    "bob",
+	acl:         "beatles, !beatles AND drums",
+	expect:      true,
+	expectFetch: true,
+}}
+
+func (s *permCheckerSuite) TestAllowACL(c *gc.C) {
+	for i, test := range allowACLTests {
+		c.Logf("%d. %s", i, test.about)
+		srv := newGroupsServer()
+		srv.setGroups(test.username, "beatles", "bass")
+		pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+		acl, err := params.ParseACL(test.acl)
+		c.Assert(err, gc.IsNil)
+		ok, err := pc.AllowACL(test.username, acl)
+		c.Assert(err, gc.IsNil)
+		c.Assert(ok, gc.Equals, test.expect)
+		if test.expectFetch {
+			c.Assert(srv.requestCount(test.username), gc.Equals, 1)
+		} else {
+			c.Assert(srv.requestCount(test.username), gc.Equals, 0)
+		}
+		srv.Close()
+	}
+}
+
+func (s *permCheckerSuite) TestAllowACLError(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setError(errgo.New("identity is down"))
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+	acl, err := params.ParseACL("everyone, !stones")
+	c.Assert(err, gc.IsNil)
+	_, err = pc.AllowACL("bob", acl)
+	c.Assert(err, gc.ErrorMatches, `cannot fetch groups: .*identity is down`)
+}
+
+func (s *permCheckerSuite) TestAllowMany(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("alice", "beatles")
+	srv.setGroups("bob", "stones")
+	srv.setGroups("charlie", "beatles", "stones")
+	srv.setUserError("dave", errgo.New("dave is broken"))
+	srv.block()
+
+	pc := idmclient.NewPermCheckerWithParams(idmclient.PermCheckerParams{
+		Client:           srv.client(),
+		CacheTime:        time.Hour,
+		FetchConcurrency: 2,
+	})
+	done := make(chan []idmclient.AllowResult)
+	go func() {
+		done <- pc.AllowMany([]string{"alice", "bob", "charlie", "dave", "eve", "fred"}, []string{"beatles", "fred"})
+	}()
+	// Check that no more than two lookups are
+	// made at the same time.
+	waitFor(c, func() bool {
+		return pc.Stats().Fetches == 2
+	})
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(pc.Stats().Fetches, gc.Equals, int64(2))
+	srv.unblock()
+
+	results := <-done
+	c.Assert(results, gc.HasLen, 6)
+	c.Assert(results[3].Username, gc.Equals, "dave")
+	c.Assert(results[3].Err, gc.ErrorMatches, `cannot fetch groups: .*dave is broken`)
+	results[3].Err = nil
+	c.Assert(results, jc.DeepEquals, []idmclient.AllowResult{{
+		Username: "alice",
+		Allowed:  true,
+	}, {
+		Username: "bob",
+	}, {
+		Username: "charlie",
+		Allowed:  true,
+	}, {
+		Username: "dave",
+	}, {
+		Username: "eve",
+	}, {
+		Username: "fred",
+		Allowed:  true,
+	}})
+	// fred is allowed by name, so no groups are fetched.
+	c.Assert(srv.requestCount("fred"), gc.Equals, 0)
+	c.Assert(pc.Stats().Fetches, gc.Equals, int64(5))
+}
+
+func (s *permCheckerSuite) TestAllowManyEmpty(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+	c.Assert(pc.AllowMany(nil, []string{"everyone"}), gc.HasLen, 0)
+}
+
+func (s *permCheckerSuite) TestACLMatches(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setGroups("bob", "beatles", "bass")
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+
+	matches, err := pc.ACLMatches("bob", []string{"stones", "everyone", "beatles", "bob", "bass"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(matches, jc.DeepEquals, []idmclient.ACLMatch{{
+		Entry:  "everyone",
+		Reason: idmclient.MatchEveryone,
+	}, {
+		Entry:  "beatles",
+		Reason: idmclient.MatchGroup,
+	}, {
+		Entry:  "bob",
+		Reason: idmclient.MatchUser,
+	}, {
+		Entry:  "bass",
+		Reason: idmclient.MatchGroup,
+	}})
+	c.Assert(matches[1].Reason.String(), gc.Equals, "group")
+
+	// The groups are cached, so a second query does
+	// not contact the server.
+	matches, err = pc.ACLMatches("bob", []string{"stones"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(matches, gc.HasLen, 0)
+	c.Assert(srv.requestCount("bob"), gc.Equals, 1)
+
+	// Groups are not fetched when no entry needs them.
+	matches, err = pc.ACLMatches("alice", []string{"alice", "everyone"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(matches, jc.DeepEquals, []idmclient.ACLMatch{{
+		Entry:  "alice",
+		Reason: idmclient.MatchUser,
+	}, {
+		Entry:  "everyone",
+		Reason: idmclient.MatchEveryone,
+	}})
+	c.Assert(srv.requestCount("alice"), gc.Equals, 0)
+}
+
+func (s *permCheckerSuite) TestACLMatchesError(c *gc.C) {
+	srv := newGroupsServer()
+	defer srv.Close()
+	srv.setError(errgo.New("identity is down"))
+	pc := idmclient.NewPermChecker(srv.client(), time.Hour)
+	_, err := pc.ACLMatches("bob", []string{"everyone", "beatles"})
+	c.Assert(err, gc.ErrorMatches, `cannot fetch groups: .*identity is down`)
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/CanonicalLtd/usso"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/juju/identity/params"
+)
+
+// ErrLoginMethodNotSupported is the cause of the error returned by
+// LoginMethod.Login when the identity server does not offer that
+// login method.
+var ErrLoginMethodNotSupported = errgo.New("login method not supported")
+
+// LoginMethod represents a way of logging in to the identity server.
+type LoginMethod interface {
+	// Name returns a short name for the login method,
+	// used in error messages.
+	Name() string
+
+	// Login logs in using the login methods advertised by the
+	// identity server at the given visit URL. If the identity
+	// server does not offer the method, Login returns an error
+	// with an ErrLoginMethodNotSupported cause.
+	Login(visitURL *url.URL, lm *params.LoginMethods) error
+}
+
+// ContextLoginMethod is implemented by login methods that can make
+// their requests with a given context and HTTP client. When such a
+// method is used by Visitor.VisitWebPageContext, its LoginContext
+// method is called in preference to Login.
+type ContextLoginMethod interface {
+	LoginMethod
+
+	// LoginContext is like Login except that all requests are
+	// made with the given client, which may be bound to ctx, in
+	// place of the client that the method was created with.
+	LoginContext(ctx context.Context, client *http.Client, visitURL *url.URL, lm *params.LoginMethods) error
+}
+
+// Visitor performs login interactions by trying each of
+// a number of login methods in turn.
+type Visitor struct {
+	// Client is used to discover the login methods offered by the
+	// identity server. If it is nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Methods holds the login methods to try, in order of
+	// preference.
+	Methods []LoginMethod
+}
+
+// VisitWebPage fetches the login methods offered by the identity
+// server from the given visit URL and tries each of v.Methods in turn
+// until one succeeds. Methods that are not offered by the server are
+// skipped, and methods that fail fall back to the next. If the login
+// methods cannot be fetched, the methods are tried as if the server
+// offered none, so that interactive login, which is the default, can
+// still succeed. It can be used as the VisitWebPage field of an
+// httpbakery.Client.
+func (v *Visitor) VisitWebPage(u *url.URL) error {
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return v.VisitWebPageContext(context.Background(), client, u)
+}
+
+// VisitWebPageContext is like VisitWebPage except that all requests,
+// including those made by methods that implement ContextLoginMethod,
+// are made with the given client in place of v.Client. When v is used
+// as the Visitor in NewParams, the client's context-aware methods call
+// VisitWebPageContext with a client bound to their context, so that
+// cancelling the context cancels any login requests in flight.
+func (v *Visitor) VisitWebPageContext(ctx context.Context, client *http.Client, u *url.URL) error {
+	lm, lmErr := loginMethods(client, u)
+	if lmErr != nil {
+		// Servers are not obliged to return a list of login
+		// methods, so try the methods anyway.
+		lm = &params.LoginMethods{}
+	}
+	var errs []string
+	for _, m := range v.Methods {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		if cm, ok := m.(ContextLoginMethod); ok {
+			err = cm.LoginContext(ctx, client, u, lm)
+		} else {
+			err = m.Login(u, lm)
+		}
+		if err == nil {
+			return nil
+		}
+		if errgo.Cause(err) == ErrLoginMethodNotSupported {
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", m.Name(), err))
+	}
+	if lmErr != nil {
+		if len(errs) == 0 {
+			return errgo.Mask(lmErr, errgo.Any)
+		}
+		errs = append(errs, fmt.Sprintf("cannot get login methods: %v", lmErr))
+	}
+	if len(errs) == 0 {
+		return errgo.WithCausef(nil, ErrLoginMethodNotSupported, "no supported login methods found")
+	}
+	return errgo.Newf("cannot log in: %s", strings.Join(errs, "; "))
+}
+
+// AgentLoginMethod returns a LoginMethod that logs in as the agent with
+// the given username and key pair. As with AgentVisitWebPage, the
+// httpbakery.Client using the method must have its Key field set to
+// key.
+func AgentLoginMethod(client *http.Client, username string, key *bakery.KeyPair) LoginMethod {
+	return &agentLoginMethod{
+		client:   client,
+		username: username,
+		key:      key,
+	}
+}
+
+type agentLoginMethod struct {
+	client   *http.Client
+	username string
+	key      *bakery.KeyPair
+}
+
+// Name implements LoginMethod.Name.
+func (m *agentLoginMethod) Name() string {
+	return "agent"
+}
+
+// Login implements LoginMethod.Login.
+func (m *agentLoginMethod) Login(visitURL *url.URL, lm *params.LoginMethods) error {
+	return m.LoginContext(context.Background(), m.client, visitURL, lm)
+}
+
+// LoginContext implements ContextLoginMethod.LoginContext.
+func (m *agentLoginMethod) LoginContext(_ context.Context, client *http.Client, _ *url.URL, lm *params.LoginMethods) error {
+	if lm.Agent == "" {
+		return errgo.WithCausef(nil, ErrLoginMethodNotSupported, "agent login not supported")
+	}
+	return errgo.Mask(agentLogin(client, m.username, m.key, lm), errgo.Any)
+}
+
+// UbuntuSSOOAuthLoginMethod returns a LoginMethod that logs in
+// using the given Ubuntu SSO OAuth credentials.
+func UbuntuSSOOAuthLoginMethod(client *http.Client, tok *usso.SSOData) LoginMethod {
+	return &ussoOAuthLoginMethod{
+		client: client,
+		tok:    tok,
+	}
+}
+
+type ussoOAuthLoginMethod struct {
+	client *http.Client
+	tok    *usso.SSOData
+}
+
+// Name implements LoginMethod.Name.
+func (m *ussoOAuthLoginMethod) Name() string {
+	return "usso_oauth"
+}
+
+// Login implements LoginMethod.Login.
+func (m *ussoOAuthLoginMethod) Login(visitURL *url.URL, lm *params.LoginMethods) error {
+	return m.LoginContext(context.Background(), m.client, visitURL, lm)
+}
+
+// LoginContext implements ContextLoginMethod.LoginContext.
+func (m *ussoOAuthLoginMethod) LoginContext(_ context.Context, client *http.Client, _ *url.URL, lm *params.LoginMethods) error {
+	if lm.UbuntuSSOOAuth == "" {
+		return errgo.WithCausef(nil, ErrLoginMethodNotSupported, "Ubuntu SSO OAuth login not supported")
+	}
+	return errgo.Mask(ussoOAuthLogin(client, m.tok, lm.UbuntuSSOOAuth), errgo.Any)
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmclient_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/CanonicalLtd/usso"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/idmtest"
+	"github.com/juju/identity/params"
+)
+
+type visitorSuite struct{}
+
+var _ = gc.Suite(&visitorSuite{})
+
+func (*visitorSuite) TestVisitorFallsBackToSupportedMethod(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", "beatles")
+	key := srv.UserPublicKey("bob")
+	bclient := httpbakery.NewClient()
+	bclient.Key = key
+	failing := &testLoginMethod{
+		name: "failing",
+		err:  errgo.New("something went wrong"),
+	}
+	v := &idmclient.Visitor{
+		Client: bclient.Client,
+		Methods: []idmclient.LoginMethod{
+			idmclient.UbuntuSSOOAuthLoginMethod(bclient.Client, &usso.SSOData{}),
+			failing,
+			idmclient.AgentLoginMethod(bclient.Client, "bob", key),
+		},
+	}
+	bclient.VisitWebPage = v.VisitWebPage
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+	groups, err := client.UserGroups(&params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(groups, jc.DeepEquals, []string{"beatles"})
+	c.Assert(failing.called, gc.Equals, 1)
+	c.Assert(failing.lm.Agent, gc.Not(gc.Equals), "")
+}
+
+func (*visitorSuite) TestVisitorNoSupportedMethods(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	bclient := httpbakery.NewClient()
+	v := &idmclient.Visitor{
+		Client: bclient.Client,
+		Methods: []idmclient.LoginMethod{
+			idmclient.UbuntuSSOOAuthLoginMethod(bclient.Client, &usso.SSOData{}),
+		},
+	}
+	bclient.VisitWebPage = v.VisitWebPage
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+	_, err := client.UserGroups(&params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `.*no supported login methods found`)
+}
+
+func (*visitorSuite) TestVisitorAllMethodsFail(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	bclient := httpbakery.NewClient()
+	v := &idmclient.Visitor{
+		Client: bclient.Client,
+		Methods: []idmclient.LoginMethod{
+			&testLoginMethod{name: "m1", err: errgo.New("error 1")},
+			&testLoginMethod{name: "m2", err: errgo.New("error 2")},
+		},
+	}
+	bclient.VisitWebPage = v.VisitWebPage
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  bclient,
+	})
+	_, err := client.UserGroups(&params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `.*cannot log in: m1: error 1; m2: error 2`)
+}
+
+func (*visitorSuite) TestVisitorWithoutLoginMethods(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer srv.Close()
+	agent := &testLoginMethod{
+		name: "agent",
+		err:  errgo.WithCausef(nil, idmclient.ErrLoginMethodNotSupported, "agent login not supported"),
+	}
+	var opened *url.URL
+	v := &idmclient.Visitor{
+		Methods: []idmclient.LoginMethod{
+			agent,
+			idmclient.InteractiveLoginMethod(idmclient.InteractiveParams{
+				Open: func(u *url.URL) error {
+					opened = u
+					return nil
+				},
+			}),
+		},
+	}
+	err := v.VisitWebPage(mustParseURL(srv.URL + "/visit"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(agent.called, gc.Equals, 1)
+	c.Assert(agent.lm, jc.DeepEquals, &params.LoginMethods{})
+	c.Assert(opened.String(), gc.Equals, srv.URL+"/visit")
+
+	// If no method succeeds, the error from fetching the login
+	// methods is returned.
+	v.Methods = v.Methods[:1]
+	err = v.VisitWebPage(mustParseURL(srv.URL + "/visit"))
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal login methods: .*`)
+}
+
+type testLoginMethod struct {
+	name   string
+	err    error
+	called int
+	lm     *params.LoginMethods
+}
+
+func (m *testLoginMethod) Name() string {
+	return m.name
+}
+
+func (m *testLoginMethod) Login(_ *url.URL, lm *params.LoginMethods) error {
+	m.called++
+	m.lm = lm
+	return m.err
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmgrpc
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/juju/identity/idmclient"
+)
+
+// Client holds the macaroons acquired by a gRPC client. Its
+// interceptors send the macaroons with each call and acquire new
+// ones when the server requires them. A Client should only be used
+// for calls to a single server.
+type Client struct {
+	bclient *httpbakery.Client
+
+	// mu guards the fields below it.
+	mu        sync.Mutex
+	macaroons macaroon.Slice
+}
+
+// NewClient returns a Client that uses the given bakery client
+// to discharge macaroons. If client is nil, httpbakery.NewClient()
+// is used.
+func NewClient(client *httpbakery.Client) *Client {
+	if client == nil {
+		client = httpbakery.NewClient()
+	}
+	return &Client{
+		bclient: client,
+	}
+}
+
+// UnaryClientInterceptor returns an interceptor that sends the
+// acquired macaroons with each unary call. If the server responds that
+// a macaroon must be discharged, the interceptor discharges it and
+// retries the call.
+func (c *Client) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(c.outgoingContext(ctx), method, req, reply, cc, opts...)
+		m, ok := dischargeRequiredMacaroon(err)
+		if !ok {
+			return err
+		}
+		if err := c.discharge(ctx, m); err != nil {
+			return status.Errorf(codes.Unauthenticated, "%v", err)
+		}
+		return invoker(c.outgoingContext(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor returns an interceptor that sends the
+// acquired macaroons with each streaming call. As a streaming call
+// cannot be retried transparently, it does not acquire new macaroons;
+// the error returned from the stream can be passed to Discharge before
+// the call is retried.
+func (c *Client) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(c.outgoingContext(ctx), desc, cc, method, opts...)
+	}
+}
+
+// Discharge discharges the macaroon held in the given error, as
+// returned from a call, so that the call can be retried. The requests
+// made while discharging use the given context. It returns the
+// original error if it does not require a discharge.
+func (c *Client) Discharge(ctx context.Context, err error) error {
+	m, ok := dischargeRequiredMacaroon(err)
+	if !ok {
+		return err
+	}
+	return errgo.Mask(c.discharge(ctx, m))
+}
+
+// discharge discharges m using ctx and stores the resulting macaroons
+// for use in future calls in place of any acquired earlier.
+func (c *Client) discharge(ctx context.Context, m *macaroon.Macaroon) error {
+	ms, err := idmclient.BakeryClientWithContext(ctx, c.bclient).DischargeAll(m)
+	if err != nil {
+		return errgo.Notef(err, "cannot discharge macaroon")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.macaroons = ms
+	return nil
+}
+
+// outgoingContext returns ctx with the acquired
+// macaroons added to its outgoing metadata.
+func (c *Client) outgoingContext(ctx context.Context) context.Context {
+	c.mu.Lock()
+	ms := c.macaroons
+	c.mu.Unlock()
+	if ms == nil {
+		return ctx
+	}
+	data, err := json.Marshal(ms)
+	if err != nil {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, MacaroonsMetadataKey, string(data))
+}
+
+// dischargeRequiredMacaroon returns the macaroon held in err if it
+// is a discharge-required status, and reports whether it was.
+func dischargeRequiredMacaroon(err error) (*macaroon.Macaroon, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unauthenticated {
+		return nil, false
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.Reason != DischargeRequiredReason || info.Domain != ErrorDomain {
+			continue
+		}
+		var m macaroon.Macaroon
+		if err := json.Unmarshal([]byte(info.Metadata[macaroonMetadataKey]), &m); err != nil {
+			return nil, false
+		}
+		return &m, true
+	}
+	return nil, false
+}
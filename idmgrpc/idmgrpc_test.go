@@ -0,0 +1,221 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idmgrpc_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/idmgrpc"
+	"github.com/juju/identity/idmtest"
+	"github.com/juju/identity/params"
+)
+
+type suite struct {
+	idsrv *idmtest.Server
+}
+
+var _ = gc.Suite(&suite{})
+
+func (s *suite) SetUpTest(c *gc.C) {
+	s.idsrv = idmtest.NewServer()
+	s.idsrv.AddUser("admin", idmtest.AdminGroup)
+	s.idsrv.AddUser("bob", "beatles")
+	s.idsrv.AddUser("alice")
+}
+
+func (s *suite) TearDownTest(c *gc.C) {
+	s.idsrv.Close()
+}
+
+// testServer is a gRPC health server that records
+// the authenticated users of the calls made to it.
+type testServer struct {
+	*grpc.Server
+	addr string
+
+	mu    sync.Mutex
+	users []string
+}
+
+// newTestServer starts a gRPC server that
+// authenticates calls against s.idsrv.
+func (s *suite) newTestServer(c *gc.C, acl string) *testServer {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Locator: s.idsrv,
+	})
+	c.Assert(err, gc.IsNil)
+	p := idmgrpc.Params{
+		Bakery:           svc,
+		IdentityLocation: s.idsrv.URL.String(),
+		MacaroonExpiry:   time.Hour,
+	}
+	if acl != "" {
+		p.ACL, err = params.ParseACL(acl)
+		c.Assert(err, gc.IsNil)
+		p.PermChecker = idmclient.NewPermChecker(idmclient.New(idmclient.NewParams{
+			BaseURL: s.idsrv.URL.String(),
+			Client:  s.idsrv.Client("admin"),
+		}), time.Hour)
+	}
+	auth := idmgrpc.NewAuthenticator(p)
+	srv := new(testServer)
+	srv.Server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			auth.UnaryServerInterceptor(),
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				srv.record(ctx)
+				return handler(ctx, req)
+			},
+		),
+		grpc.ChainStreamInterceptor(
+			auth.StreamServerInterceptor(),
+			func(x interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				srv.record(ss.Context())
+				return handler(x, ss)
+			},
+		),
+	)
+	healthpb.RegisterHealthServer(srv.Server, health.NewServer())
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	srv.addr = lis.Addr().String()
+	go srv.Serve(lis)
+	return srv
+}
+
+func (srv *testServer) record(ctx context.Context) {
+	username, _ := idmclient.UsernameFromContext(ctx)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.users = append(srv.users, username)
+}
+
+func (srv *testServer) recordedUsers() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.users...)
+}
+
+// dial returns a health client connected to srv
+// that authenticates as the given user.
+func (s *suite) dial(c *gc.C, srv *testServer, username string) (healthpb.HealthClient, *idmgrpc.Client, func()) {
+	client := idmgrpc.NewClient(s.idsrv.Client(username))
+	conn, err := grpc.NewClient(srv.addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(client.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(client.StreamClientInterceptor()),
+	)
+	c.Assert(err, gc.IsNil)
+	return healthpb.NewHealthClient(conn), client, func() {
+		conn.Close()
+	}
+}
+
+func (s *suite) TestUnaryCall(c *gc.C) {
+	srv := s.newTestServer(c, "")
+	defer srv.Stop()
+	hc, _, closeConn := s.dial(c, srv, "bob")
+	defer closeConn()
+
+	// The first call acquires a discharge and is retried.
+	_, err := hc.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(srv.recordedUsers(), gc.DeepEquals, []string{"bob"})
+
+	// The second call reuses the acquired macaroons.
+	_, err = hc.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(srv.recordedUsers(), gc.DeepEquals, []string{"bob", "bob"})
+}
+
+func (s *suite) TestStreamCall(c *gc.C) {
+	srv := s.newTestServer(c, "")
+	defer srv.Stop()
+	hc, client, closeConn := s.dial(c, srv, "bob")
+	defer closeConn()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := hc.Watch(ctx, &healthpb.HealthCheckRequest{})
+	c.Assert(err, gc.IsNil)
+	_, err = stream.Recv()
+	c.Assert(status.Code(err), gc.Equals, codes.Unauthenticated)
+
+	// The discharge is made with the given context.
+	cancelledCtx, cancelDischarge := context.WithCancel(context.Background())
+	cancelDischarge()
+	c.Assert(client.Discharge(cancelledCtx, err), gc.ErrorMatches, `cannot discharge macaroon: .*context canceled`)
+
+	// After discharging, the call succeeds.
+	err = client.Discharge(ctx, err)
+	c.Assert(err, gc.IsNil)
+	stream, err = hc.Watch(ctx, &healthpb.HealthCheckRequest{})
+	c.Assert(err, gc.IsNil)
+	_, err = stream.Recv()
+	c.Assert(err, gc.IsNil)
+	c.Assert(srv.recordedUsers(), gc.DeepEquals, []string{"bob"})
+}
+
+func (s *suite) TestDischargeRequiredStatus(c *gc.C) {
+	srv := s.newTestServer(c, "")
+	defer srv.Stop()
+	conn, err := grpc.NewClient(srv.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+
+	// Without the client interceptor, the discharge-required
+	// status is returned to the caller.
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	st, ok := status.FromError(err)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(st.Code(), gc.Equals, codes.Unauthenticated)
+	c.Assert(st.Message(), gc.Matches, "discharge required: .*")
+	c.Assert(st.Details(), gc.HasLen, 1)
+}
+
+func (s *suite) TestACL(c *gc.C) {
+	srv := s.newTestServer(c, "beatles")
+	defer srv.Stop()
+
+	hc, _, closeConn := s.dial(c, srv, "bob")
+	defer closeConn()
+	_, err := hc.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	c.Assert(err, gc.IsNil)
+
+	hc, _, closeConn = s.dial(c, srv, "alice")
+	defer closeConn()
+	_, err = hc.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	c.Assert(status.Code(err), gc.Equals, codes.PermissionDenied)
+	c.Assert(err, gc.ErrorMatches, `.*access denied for user "alice"`)
+	c.Assert(srv.recordedUsers(), gc.DeepEquals, []string{"bob"})
+}
+
+func (s *suite) TestACLWithoutPermChecker(c *gc.C) {
+	acl, err := params.ParseACL("beatles")
+	c.Assert(err, gc.IsNil)
+	c.Assert(func() {
+		idmgrpc.NewAuthenticator(idmgrpc.Params{
+			ACL: acl,
+		})
+	}, gc.PanicMatches, `idmgrpc: NewAuthenticator called with an ACL but no PermChecker`)
+}
+
+func (s *suite) TestDischargeNotRequired(c *gc.C) {
+	client := idmgrpc.NewClient(nil)
+	err := status.Error(codes.NotFound, "not found")
+	c.Assert(client.Discharge(context.Background(), err), gc.Equals, err)
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package idmgrpc provides gRPC interceptors that authenticate calls
+// with macaroons discharged by the identity server.
+//
+// Macaroons are carried in the "macaroons-bin" metadata entry, each
+// value holding the JSON encoding of a macaroon.Slice. When a call is
+// not authenticated, the server interceptors fail it with an
+// Unauthenticated status that holds an errdetails.ErrorInfo detail with
+// the reason DischargeRequiredReason. The detail's metadata holds a
+// macaroon that must be discharged by the identity server before the
+// call is retried. The client interceptors do this automatically.
+package idmgrpc
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+
+	"github.com/juju/identity/idmclient"
+	"github.com/juju/identity/params"
+)
+
+const (
+	// MacaroonsMetadataKey holds the metadata key
+	// used to send macaroons with a call.
+	MacaroonsMetadataKey = "macaroons-bin"
+
+	// DischargeRequiredReason holds the reason in the ErrorInfo
+	// detail of a status that requires a macaroon to be
+	// discharged.
+	DischargeRequiredReason = "DISCHARGE_REQUIRED"
+
+	// ErrorDomain holds the domain in the ErrorInfo detail of a
+	// status that requires a macaroon to be discharged.
+	ErrorDomain = "identity"
+
+	// macaroonMetadataKey holds the ErrorInfo metadata key
+	// that holds the JSON encoding of the macaroon to discharge.
+	macaroonMetadataKey = "macaroon"
+)
+
+// Params holds the parameters for NewAuthenticator.
+type Params struct {
+	// Bakery holds the service used to check the
+	// macaroons sent with calls and to mint new ones.
+	Bakery *bakery.Service
+
+	// IdentityLocation holds the URL of the identity server
+	// that discharges the minted macaroons.
+	IdentityLocation string
+
+	// MacaroonExpiry, if non-zero, holds the length of time
+	// for which minted macaroons are valid.
+	MacaroonExpiry time.Duration
+
+	// ACL, if non-nil, holds the ACL that authenticated users
+	// must satisfy. It is checked with PermChecker, which must
+	// be non-nil if ACL is non-nil.
+	ACL         params.ACL
+	PermChecker *idmclient.PermChecker
+}
+
+// Authenticator authenticates gRPC calls made to a server.
+type Authenticator struct {
+	p Params
+}
+
+// NewAuthenticator returns an Authenticator that uses the given
+// parameters. It panics if p.ACL is non-nil and p.PermChecker is nil.
+func NewAuthenticator(p Params) *Authenticator {
+	if p.ACL != nil && p.PermChecker == nil {
+		panic("idmgrpc: NewAuthenticator called with an ACL but no PermChecker")
+	}
+	return &Authenticator{
+		p: p,
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor that authenticates
+// unary calls. The name of the authenticated user is available to the
+// handler through idmclient.UsernameFromContext.
+func (a *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor that authenticates
+// streaming calls. The name of the authenticated user is available to
+// the handler through idmclient.UsernameFromContext applied to the
+// stream's context.
+func (a *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{
+			ServerStream: ss,
+			ctx:          ctx,
+		})
+	}
+}
+
+// serverStream wraps a grpc.ServerStream to
+// replace its context.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context implements grpc.ServerStream.Context.
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticate checks the macaroons sent with the call that has the
+// given context and returns a context holding the name of the
+// authenticated user. The returned error is suitable for returning
+// from a gRPC handler.
+func (a *Authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	username, err := a.checkMacaroons(ctx)
+	if err != nil {
+		if _, ok := errgo.Cause(err).(*bakery.VerificationError); !ok {
+			return nil, status.Errorf(codes.Unauthenticated, "%v", err)
+		}
+		return nil, a.dischargeRequiredError(err)
+	}
+	if a.p.ACL != nil {
+		ok, err := a.p.PermChecker.AllowACLContext(ctx, username, a.p.ACL)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "cannot check permissions: %v", err)
+		}
+		if !ok {
+			return nil, status.Errorf(codes.PermissionDenied, "access denied for user %q", username)
+		}
+	}
+	return idmclient.ContextWithUsername(ctx, username), nil
+}
+
+// checkMacaroons checks the macaroons in the incoming metadata of ctx
+// and returns the declared username. A *bakery.VerificationError is
+// returned if the macaroons do not authenticate a user.
+func (a *Authenticator) checkMacaroons(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var mss []macaroon.Slice
+	for _, v := range md.Get(MacaroonsMetadataKey) {
+		var ms macaroon.Slice
+		if err := json.Unmarshal([]byte(v), &ms); err != nil {
+			return "", errgo.Notef(err, "cannot unmarshal macaroons")
+		}
+		mss = append(mss, ms)
+	}
+	attrs, err := a.p.Bakery.CheckAny(mss, nil, checkers.New(checkers.TimeBefore))
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	username := attrs["username"]
+	if username == "" {
+		return "", &bakery.VerificationError{
+			Reason: errgo.New("no username declared"),
+		}
+	}
+	return username, nil
+}
+
+// dischargeRequiredError returns a status error holding a new macaroon
+// that must be discharged by the identity server.
+func (a *Authenticator) dischargeRequiredError(verr error) error {
+	m, err := idmclient.NewAuthMacaroon(a.p.Bakery, a.p.IdentityLocation, a.p.MacaroonExpiry)
+	if err != nil {
+		return status.Errorf(codes.Internal, "%v", err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot marshal macaroon: %v", err)
+	}
+	st, err := status.New(codes.Unauthenticated, "discharge required: "+verr.Error()).WithDetails(&errdetails.ErrorInfo{
+		Reason: DischargeRequiredReason,
+		Domain: ErrorDomain,
+		Metadata: map[string]string{
+			macaroonMetadataKey: string(data),
+		},
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot make status: %v", err)
+	}
+	return st.Err()
+}
@@ -6,11 +6,15 @@
 package idmtest
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/httprequest"
 	"github.com/julienschmidt/httprouter"
@@ -19,51 +23,86 @@ import (
 	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v1/httpbakery"
 	"gopkg.in/macaroon-bakery.v1/httpbakery/agent"
+	"gopkg.in/macaroon.v1"
 
 	"github.com/juju/identity/params"
 )
 
+// AdminGroup holds the name of the group whose members are treated as
+// administrators by the mock identity server.
+const AdminGroup = "admin@idm"
+
+// tokenExpiry holds the length of time for which a token
+// returned by the UserToken endpoint is valid.
+const tokenExpiry = 24 * time.Hour
+
 // Server represents a mock identity server.
-// It currently serves only the discharge and groups endpoints.
+// It currently serves the discharge endpoints, the
+// user endpoints under /v1/u and the /v1/changes endpoint.
 type Server struct {
 	// URL holds the URL of the mock identity server.
 	// The discharger endpoint is located at URL/v1/discharge.
 	URL *url.URL
 
 	// PublicKey holds the public key of the mock identity server.
+	// It is updated by RotateKey.
 	PublicKey *bakery.PublicKey
 
 	router *httprouter.Router
 	srv    *httptest.Server
-	bakery *bakery.Service
 
 	// mu guards the fields below it.
-	mu          sync.Mutex
-	users       map[string]*user
-	defaultUser string
-	waits       []chan struct{}
+	mu            sync.Mutex
+	bakery        *bakery.Service
+	discharger    http.Handler
+	users         map[string]*user
+	defaultUser   string
+	adminUsername string
+	adminPassword string
+	waits         []*waitState
+
+	// changes holds all the changes made to users, and
+	// changed is closed and replaced when a change is made.
+	changes []params.UserChange
+	changed chan struct{}
 }
 
 type user struct {
-	groups []string
-	key    *bakery.KeyPair
+	info params.User
+
+	// keys holds the key pairs generated by the server for the
+	// user, in the order they were added. Only those whose public
+	// keys are in info.PublicKeys may be used to log in.
+	keys      []*bakery.KeyPair
+	extraInfo map[string]json.RawMessage
+}
+
+// waitState holds the state of a discharge that is waiting
+// for the client to log in.
+type waitState struct {
+	// done receives a value when the login has completed.
+	done chan struct{}
+
+	// username and key hold the name and public key of the
+	// user that is logging in. They are empty until known.
+	username string
+	key      *bakery.PublicKey
 }
 
 // NewServer runs a mock identity server. It can discharge
-// macaroons and return information on user group membership.
+// macaroons and return information on users and their group
+// membership.
 // The returned server should be closed after use.
 func NewServer() *Server {
 	srv := &Server{
-		users: make(map[string]*user),
+		users:   make(map[string]*user),
+		changed: make(chan struct{}),
 	}
-	bsvc, err := bakery.NewService(bakery.NewServiceParams{
-		Locator: srv,
-	})
+	key, err := bakery.GenerateKey()
 	if err != nil {
 		panic(err)
 	}
-	srv.bakery = bsvc
-	srv.PublicKey = bsvc.PublicKey()
+	srv.setKey(key)
 	errorMapper := httprequest.ErrorMapper(errToResp)
 	h := &handler{
 		srv: srv,
@@ -74,10 +113,9 @@ func NewServer() *Server {
 	}) {
 		router.Handle(route.Method, route.Path, route.Handle)
 	}
-	mux := http.NewServeMux()
-	httpbakery.AddDischargeHandler(mux, "/v1/discharger", srv.bakery, srv.check)
-	router.Handler("POST", "/v1/discharger/*rest", mux)
-	router.Handler("GET", "/v1/discharger/*rest", mux)
+	discharger := http.HandlerFunc(srv.serveDischarge)
+	router.Handler("POST", "/v1/discharger/*rest", discharger)
+	router.Handler("GET", "/v1/discharger/*rest", discharger)
 
 	srv.srv = httptest.NewServer(router)
 	srv.URL, err = url.Parse(srv.srv.URL)
@@ -138,29 +176,118 @@ func (srv *Server) Close() {
 // PublicKeyForLocation implements bakery.PublicKeyLocator
 // by returning the server's public key for all locations.
 func (srv *Server) PublicKeyForLocation(loc string) (*bakery.PublicKey, error) {
-	return srv.PublicKey, nil
+	return srv.service().PublicKey(), nil
+}
+
+// RotateKey replaces the server's key pair with a newly generated one
+// and returns the new public key. Macaroons minted by the server
+// before the rotation will no longer verify, and third party caveats
+// addressed to the old key can no longer be discharged.
+func (srv *Server) RotateKey() *bakery.PublicKey {
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	srv.setKey(key)
+	return &key.Public
+}
+
+// setKey sets the key pair used by the server's bakery service
+// and discharger.
+func (srv *Server) setKey(key *bakery.KeyPair) {
+	bsvc, err := bakery.NewService(bakery.NewServiceParams{
+		Key:     key,
+		Locator: srv,
+	})
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	httpbakery.AddDischargeHandler(mux, "/v1/discharger", bsvc, srv.check)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.bakery = bsvc
+	srv.discharger = mux
+	srv.PublicKey = bsvc.PublicKey()
+}
+
+// service returns the server's current bakery service.
+func (srv *Server) service() *bakery.Service {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.bakery
 }
 
-// UserPublicKey returns the key for the given user.
-// It panics if the user has not been added.
+// serveDischarge serves the discharge endpoints using the
+// current bakery service.
+func (srv *Server) serveDischarge(w http.ResponseWriter, req *http.Request) {
+	srv.mu.Lock()
+	discharger := srv.discharger
+	srv.mu.Unlock()
+	discharger.ServeHTTP(w, req)
+}
+
+// UserPublicKey returns the key pair used by Client to log in as the
+// given user: the most recently added key pair generated by the server
+// whose public key is still one of the user's public keys. It panics if
+// the user has not been added or if there is no such key pair.
 func (srv *Server) UserPublicKey(username string) *bakery.KeyPair {
-	u := srv.user(username)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	u := srv.users[username]
+	if u == nil {
+		panic("no user found")
+	}
+	key := u.clientKey()
+	if key == nil {
+		panic(fmt.Sprintf("no server-generated key registered for user %q", username))
+	}
+	return key
+}
+
+// AddUserKey generates a new key pair, adds its public key to the
+// public keys of the given user alongside any existing ones and
+// returns it. It panics if the user has not been added.
+func (srv *Server) AddUserKey(username string) *bakery.KeyPair {
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	u := srv.users[username]
+	if u == nil {
+		panic("no user found")
+	}
+	u.keys = append(u.keys, key)
+	u.info.PublicKeys = append(u.info.PublicKeys, &key.Public)
+	srv.recordChange(username)
+	return key
+}
+
+// UserPublicKeys returns all the public keys registered for the given
+// user. It panics if the user has not been added.
+func (srv *Server) UserPublicKeys(username string) []*bakery.PublicKey {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	u := srv.users[username]
 	if u == nil {
 		panic("no user found")
 	}
-	return u.key
+	return append([]*bakery.PublicKey(nil), u.info.PublicKeys...)
 }
 
 // Client returns a bakery client that will discharge as the given user.
-// If the user does not exist, it is added with no groups.
+// If the user does not exist, it is added with no groups. The client
+// logs in with the key pair returned by UserPublicKey, so Client panics
+// if the user's public keys have been replaced by ones that were not
+// generated by the server.
 func (srv *Server) Client(username string) *httpbakery.Client {
 	c := httpbakery.NewClient()
-	u := srv.user(username)
-	if u == nil {
+	if srv.user(username) == nil {
 		srv.AddUser(username)
-		u = srv.user(username)
 	}
-	c.Key = u.key
+	c.Key = srv.UserPublicKey(username)
 	agent.SetUpAuth(c, srv.URL, username)
 	return c
 }
@@ -177,6 +304,18 @@ func (srv *Server) SetDefaultUser(name string) {
 	srv.defaultUser = name
 }
 
+// SetAdminCredentials sets the username and password that may be
+// used with HTTP basic authentication to make admin requests to the
+// server. If the username is empty, basic authentication will be
+// rejected. Note that members of AdminGroup may also make admin
+// requests.
+func (srv *Server) SetAdminCredentials(username, password string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.adminUsername = username
+	srv.adminPassword = password
+}
+
 // AddUser adds a new user that's in the given set of groups.
 func (srv *Server) AddUser(name string, groups ...string) {
 	key, err := bakery.GenerateKey()
@@ -186,9 +325,58 @@ func (srv *Server) AddUser(name string, groups ...string) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	srv.users[name] = &user{
-		groups: groups,
-		key:    key,
+		info: params.User{
+			Username:   params.Username(name),
+			IDPGroups:  groups,
+			PublicKeys: []*bakery.PublicKey{&key.Public},
+		},
+		keys: []*bakery.KeyPair{key},
+	}
+	srv.recordChange(name)
+}
+
+// SetUserExtraInfo sets the given items in the extra information
+// stored for the given user. Items not mentioned in info are left
+// unchanged. It panics if the user has not been added or if any item
+// is invalid.
+func (srv *Server) SetUserExtraInfo(username string, info map[string]interface{}) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	u := srv.users[username]
+	if u == nil {
+		panic("no user found")
+	}
+	if err := u.setExtraInfo(info); err != nil {
+		panic(err)
 	}
+	srv.recordChange(username)
+}
+
+// UserExtraInfo returns the extra information stored for the given
+// user. It panics if the user has not been added.
+func (srv *Server) UserExtraInfo(username string) map[string]interface{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	u := srv.users[username]
+	if u == nil {
+		panic("no user found")
+	}
+	info, err := u.getExtraInfo()
+	if err != nil {
+		panic(err)
+	}
+	return info
+}
+
+// recordChange records that the given user has changed.
+// It must be called with srv.mu held.
+func (srv *Server) recordChange(username string) {
+	srv.changes = append(srv.changes, params.UserChange{
+		Seq:      uint64(len(srv.changes) + 1),
+		Username: params.Username(username),
+	})
+	close(srv.changed)
+	srv.changed = make(chan struct{})
 }
 
 func (srv *Server) user(name string) *user {
@@ -214,63 +402,491 @@ func (srv *Server) check(req *http.Request, cavId, cav string) ([]checkers.Cavea
 				checkers.DeclaredCaveat("username", srv.defaultUser),
 			}, nil
 		}
+		// There is no cookie, so the client will need to discover
+		// the available login methods from the visit URL.
+		return nil, srv.interactionRequiredError(cavId, &waitState{})
 	}
 	if err != nil {
 		return nil, errgo.Notef(err, "bad agent-login cookie in request")
 	}
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-
-	waitId := len(srv.waits)
-	srv.waits = append(srv.waits, make(chan struct{}, 1))
 	// Return a visit URL so that the client code is forced through that
 	// path, testing that its client correctly visits the URL and that
 	// any agent-login cookie has been appropriately set.
-	return nil, &httpbakery.Error{
+	return nil, srv.interactionRequiredError(cavId, &waitState{
+		username: username,
+		key:      key,
+	})
+}
+
+// interactionRequiredError registers the given wait state and returns
+// an error that directs the client to the associated visit and wait
+// URLs. It must be called with srv.mu held.
+func (srv *Server) interactionRequiredError(cavId string, w *waitState) error {
+	waitId := len(srv.waits)
+	w.done = make(chan struct{}, 1)
+	srv.waits = append(srv.waits, w)
+	return &httpbakery.Error{
 		Code: httpbakery.ErrInteractionRequired,
 		Info: &httpbakery.ErrorInfo{
 			VisitURL: fmt.Sprintf("%s/v1/login/%d", srv.URL, waitId),
-			WaitURL:  fmt.Sprintf("%s/v1/wait/%d?username=%s&caveat-id=%s&pubkey=%v", srv.URL, waitId, username, url.QueryEscape(cavId), url.QueryEscape(key.String())),
+			WaitURL:  fmt.Sprintf("%s/v1/wait/%d?caveat-id=%s", srv.URL, waitId, url.QueryEscape(cavId)),
 		},
 	}
 }
 
+// lookupWait returns the wait state with the given id.
+// It must be called with srv.mu held.
+func (srv *Server) lookupWait(id int) (*waitState, error) {
+	if id < 0 || id >= len(srv.waits) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "wait id %d not found", id)
+	}
+	return srv.waits[id], nil
+}
+
 type handler struct {
 	srv *Server
 }
 
-type groupsRequest struct {
-	httprequest.Route `httprequest:"GET /v1/u/:User/groups"`
-	User              string `httprequest:",path"`
+// QueryUsers returns the names of all the users, or only those with the
+// given external ID if that is specified.
+func (h *handler) QueryUsers(p httprequest.Params, req *params.QueryUsersRequest) ([]string, error) {
+	if err := h.checkRequest(p.Request); err != nil {
+		return nil, err
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	usernames := make([]string, 0, len(h.srv.users))
+	for name, u := range h.srv.users {
+		if req.ExternalID != "" && u.info.ExternalID != req.ExternalID {
+			continue
+		}
+		usernames = append(usernames, name)
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+// User returns the details of the given user.
+func (h *handler) User(p httprequest.Params, req *params.UserRequest) (*params.User, error) {
+	if err := h.checkRequest(p.Request); err != nil {
+		return nil, err
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	u, err := h.srv.lookupUser(req.Username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	info := copyUser(&u.info)
+	return &info, nil
+}
+
+// SetUser creates or updates the given user. As with the real identity
+// server, either an external ID or an owner must be specified, and the
+// username of an agent must end with "@" followed by the name of its
+// owner. If the user already exists, any IDPGroups in the request are
+// ignored; everything else, including the public keys, is replaced by
+// the request. Only administrators may set users, except that a user
+// may set the details of agents that they own, either by creating a new
+// agent or by updating one that they already own.
+func (h *handler) SetUser(p httprequest.Params, req *params.SetUserRequest) error {
+	username, err := h.requestUser(p.Request)
+	if err != nil {
+		return err
+	}
+	// The lock is held from the ownership check until the user is
+	// stored so that the owner cannot change in between.
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	owner := req.User.Owner
+	if u := h.srv.users[string(req.Username)]; u != nil && u.info.Owner != owner {
+		// Only an administrator may change the owner of an
+		// existing user.
+		owner = ""
+	}
+	if err := h.srv.checkAllowed(username, owner); err != nil {
+		return err
+	}
+	switch {
+	case req.User.ExternalID == "" && req.User.Owner == "":
+		return errgo.WithCausef(nil, params.ErrBadRequest, "external_id or owner must be specified")
+	case req.User.ExternalID != "" && req.User.Owner != "":
+		return errgo.WithCausef(nil, params.ErrBadRequest, "external_id and owner cannot both be specified")
+	case req.User.Owner != "" && !strings.HasSuffix(string(req.Username), "@"+string(req.User.Owner)):
+		return errgo.WithCausef(nil, params.ErrForbidden, "%s cannot create user %q (suffix must be %q)", req.User.Owner, req.Username, "@"+req.User.Owner)
+	}
+	if req.User.ExternalID != "" {
+		for name, u := range h.srv.users {
+			if name != string(req.Username) && u.info.ExternalID == req.User.ExternalID {
+				return errgo.WithCausef(nil, params.ErrAlreadyExists, "cannot store identity: external_id %q already in use", req.User.ExternalID)
+			}
+		}
+	}
+	info := copyUser(&req.User)
+	info.Username = req.Username
+	if u := h.srv.users[string(req.Username)]; u != nil {
+		info.IDPGroups = u.info.IDPGroups
+		u.info = info
+		h.srv.recordChange(string(req.Username))
+		return nil
+	}
+	h.srv.users[string(req.Username)] = &user{
+		info: info,
+	}
+	h.srv.recordChange(string(req.Username))
+	return nil
+}
+
+// UserGroups returns the groups that the given user is a member of.
+func (h *handler) UserGroups(p httprequest.Params, req *params.UserGroupsRequest) ([]string, error) {
+	if err := h.checkRequest(p.Request); err != nil {
+		return nil, err
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	u, err := h.srv.lookupUser(req.Username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return append([]string(nil), u.info.IDPGroups...), nil
+}
+
+// UserIDPGroups serves the deprecated idpgroups endpoint.
+func (h *handler) UserIDPGroups(p httprequest.Params, req *params.UserIDPGroupsRequest) ([]string, error) {
+	return h.UserGroups(p, &req.UserGroupsRequest)
+}
+
+// UserExtraInfo returns all the extra information stored for the
+// given user.
+func (h *handler) UserExtraInfo(p httprequest.Params, req *params.UserExtraInfoRequest) (map[string]interface{}, error) {
+	if err := h.checkRequest(p.Request); err != nil {
+		return nil, err
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	u, err := h.srv.lookupUser(req.Username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return u.getExtraInfo()
+}
+
+// SetUserExtraInfo sets the given items of extra information for the
+// given user. As with the real identity server, items not mentioned in
+// the request are left unchanged. Only administrators may set extra
+// information.
+func (h *handler) SetUserExtraInfo(p httprequest.Params, req *params.SetUserExtraInfoRequest) error {
+	if err := h.checkAdmin(p.Request); err != nil {
+		return err
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	u, err := h.srv.lookupUser(req.Username)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := u.setExtraInfo(req.ExtraInfo); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	h.srv.recordChange(string(req.Username))
+	return nil
 }
 
-func (h *handler) GetGroups(p httprequest.Params, req *groupsRequest) ([]string, error) {
+// UserExtraInfoItem returns a single item of extra information for
+// the given user.
+func (h *handler) UserExtraInfoItem(p httprequest.Params, req *params.UserExtraInfoItemRequest) (interface{}, error) {
 	if err := h.checkRequest(p.Request); err != nil {
 		return nil, err
 	}
-	if u := h.srv.user(req.User); u != nil {
-		return u.groups, nil
+	if err := checkExtraInfoKey(req.Item); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	u, err := h.srv.lookupUser(req.Username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	data, ok := u.extraInfo[req.Item]
+	if !ok {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "item %q not found for user %q", req.Item, req.Username)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal item %q", req.Item)
+	}
+	return v, nil
+}
+
+// SetUserExtraInfoItem sets a single item of extra information for
+// the given user. Only administrators may set extra information.
+func (h *handler) SetUserExtraInfoItem(p httprequest.Params, req *params.SetUserExtraInfoItemRequest) error {
+	if err := h.checkAdmin(p.Request); err != nil {
+		return err
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	u, err := h.srv.lookupUser(req.Username)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := u.setExtraInfo(map[string]interface{}{
+		req.Item: req.Data,
+	}); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	h.srv.recordChange(string(req.Username))
+	return nil
+}
+
+// UserChanges returns the changes made to users after req.Since. If
+// there are none, it waits for up to req.Timeout milliseconds for a
+// change to be made. As the mock server holds its changes in memory, a
+// request for changes after a point it does not know about is reported
+// as truncated.
+func (h *handler) UserChanges(p httprequest.Params, req *params.UserChangesRequest) (*params.UserChangesResponse, error) {
+	if err := h.checkRequest(p.Request); err != nil {
+		return nil, err
+	}
+	timeout := time.After(time.Duration(req.Timeout) * time.Millisecond)
+	for {
+		h.srv.mu.Lock()
+		resp := &params.UserChangesResponse{
+			Changes: []params.UserChange{},
+			Latest:  uint64(len(h.srv.changes)),
+		}
+		changed := h.srv.changed
+		switch {
+		case req.LatestOnly:
+			h.srv.mu.Unlock()
+			return resp, nil
+		case req.Since > resp.Latest:
+			resp.Changes = append(resp.Changes, h.srv.changes...)
+			resp.Truncated = true
+		case req.Since < resp.Latest:
+			resp.Changes = append(resp.Changes, h.srv.changes[req.Since:]...)
+		}
+		h.srv.mu.Unlock()
+		if len(resp.Changes) > 0 || resp.Truncated || req.Timeout <= 0 {
+			return resp, nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return resp, nil
+		case <-p.Request.Context().Done():
+			return nil, errgo.Mask(p.Request.Context().Err())
+		}
+	}
+}
+
+// UserToken returns a macaroon that declares the given user's
+// identity. Only administrators may request a token.
+func (h *handler) UserToken(p httprequest.Params, req *params.UserTokenRequest) (*macaroon.Macaroon, error) {
+	if err := h.checkAdmin(p.Request); err != nil {
+		return nil, err
+	}
+	h.srv.mu.Lock()
+	_, err := h.srv.lookupUser(req.Username)
+	h.srv.mu.Unlock()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	m, err := h.srv.service().NewMacaroon("", nil, []checkers.Caveat{
+		checkers.DeclaredCaveat("username", string(req.Username)),
+		checkers.TimeBeforeCaveat(time.Now().Add(tokenExpiry)),
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot mint macaroon")
+	}
+	return m, nil
+}
+
+// VerifyToken verifies that the given macaroons were minted by the
+// server and returns the attributes that they declare.
+func (h *handler) VerifyToken(req *params.VerifyTokenRequest) (map[string]string, error) {
+	attrs, err := h.srv.service().CheckAny([]macaroon.Slice{req.Macaroons}, nil, checkers.New(checkers.TimeBefore))
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrForbidden, "verification failure")
+	}
+	return attrs, nil
+}
+
+// PublicKey returns the server's current public key.
+func (h *handler) PublicKey(*params.PublicKeyRequest) (*params.PublicKeyResponse, error) {
+	return &params.PublicKeyResponse{
+		PublicKey: h.srv.service().PublicKey(),
+	}, nil
+}
+
+// lookupUser returns the user with the given name, or an error with a
+// params.ErrNotFound cause if there is no such user. It must be called
+// with srv.mu held.
+func (srv *Server) lookupUser(name params.Username) (*user, error) {
+	u := srv.users[string(name)]
+	if u == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "user %q not found", name)
+	}
+	return u, nil
+}
+
+// setExtraInfo stores the given items in the user's extra information.
+// No items are stored if any of them is invalid.
+func (u *user) setExtraInfo(info map[string]interface{}) error {
+	items := make(map[string]json.RawMessage, len(info))
+	for k, v := range info {
+		if err := checkExtraInfoKey(k); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return errgo.WithCausef(err, params.ErrBadRequest, "cannot marshal item %q", k)
+		}
+		items[k] = data
+	}
+	if u.extraInfo == nil {
+		u.extraInfo = make(map[string]json.RawMessage)
+	}
+	for k, data := range items {
+		u.extraInfo[k] = data
+	}
+	return nil
+}
+
+// getExtraInfo returns a copy of the user's extra information.
+func (u *user) getExtraInfo() (map[string]interface{}, error) {
+	info := make(map[string]interface{}, len(u.extraInfo))
+	for k, data := range u.extraInfo {
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal item %q", k)
+		}
+		info[k] = v
+	}
+	return info, nil
+}
+
+// checkExtraInfoKey checks that the given extra-info item name is
+// valid. Names must be non-empty and, as in the real identity server,
+// may not contain '.' or '$' characters.
+func checkExtraInfoKey(key string) error {
+	if key == "" || strings.ContainsAny(key, ".$") {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "%q bad key for extra-info", key)
+	}
+	return nil
+}
+
+// copyUser returns a copy of u that shares no mutable
+// state with it.
+func copyUser(u *params.User) params.User {
+	u1 := *u
+	u1.IDPGroups = append([]string(nil), u.IDPGroups...)
+	if u.PublicKeys != nil {
+		// Keep an empty slice distinct from nil so that the
+		// user's details are returned exactly as they were set.
+		u1.PublicKeys = append([]*bakery.PublicKey{}, u.PublicKeys...)
 	}
-	return nil, params.ErrNotFound
+	return u1
 }
 
+// checkRequest checks that the request is authenticated, either with
+// admin credentials or with a macaroon discharged by the server.
 func (h *handler) checkRequest(req *http.Request) error {
-	_, err := httpbakery.CheckRequest(h.srv.bakery, req, nil, checkers.New())
+	if _, _, ok := req.BasicAuth(); ok {
+		return h.checkAdminCredentials(req)
+	}
+	_, err := h.authenticate(req)
+	return err
+}
+
+// authenticate checks that the request is authenticated with a
+// macaroon discharged by the server and returns the name of the
+// authenticated user.
+func (h *handler) authenticate(req *http.Request) (string, error) {
+	attrs, err := httpbakery.CheckRequest(h.srv.service(), req, nil, checkers.New())
 	if err == nil {
-		return nil
+		return attrs["username"], nil
 	}
 	_, ok := errgo.Cause(err).(*bakery.VerificationError)
 	if !ok {
-		return err
+		return "", err
 	}
-	m, err := h.srv.bakery.NewMacaroon("", nil, []checkers.Caveat{{
+	m, err := h.srv.service().NewMacaroon("", nil, []checkers.Caveat{{
 		Location:  h.srv.URL.String() + "/v1/discharger",
 		Condition: "is-authenticated-user",
 	}})
 	if err != nil {
 		panic(err)
 	}
-	return httpbakery.NewDischargeRequiredErrorForRequest(m, "", err, req)
+	return "", httpbakery.NewDischargeRequiredErrorForRequest(m, "", err, req)
+}
+
+// checkAdmin checks that the request is authenticated as an
+// administrator. If the request contains basic authentication
+// credentials they must match the admin credentials; otherwise the
+// request must be authenticated with a macaroon as a member of
+// AdminGroup.
+func (h *handler) checkAdmin(req *http.Request) error {
+	return h.checkAdminOrUser(req, "")
+}
+
+// checkAdminOrUser is like checkAdmin except that it also allows
+// requests authenticated with a macaroon as the given user.
+func (h *handler) checkAdminOrUser(req *http.Request, allowed params.Username) error {
+	username, err := h.requestUser(req)
+	if err != nil {
+		return err
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	return h.srv.checkAllowed(username, allowed)
+}
+
+// requestUser authenticates the given request and returns the name of
+// the user making it, or the empty string if it is made with the admin
+// credentials.
+func (h *handler) requestUser(req *http.Request) (string, error) {
+	if _, _, ok := req.BasicAuth(); ok {
+		return "", h.checkAdminCredentials(req)
+	}
+	return h.authenticate(req)
+}
+
+// checkAllowed checks that the given user, as returned by requestUser,
+// is an administrator or is the allowed user. It must be called with
+// srv.mu held.
+func (srv *Server) checkAllowed(username string, allowed params.Username) error {
+	if username == "" {
+		return nil
+	}
+	if allowed != "" && username == string(allowed) {
+		return nil
+	}
+	if u := srv.users[username]; u != nil {
+		for _, g := range u.info.IDPGroups {
+			if g == AdminGroup {
+				return nil
+			}
+		}
+	}
+	return errgo.WithCausef(nil, params.ErrNoAdminCredsProvided, "no admin credentials provided and user %q is not an administrator", username)
+}
+
+// checkAdminCredentials checks that the basic authentication
+// credentials in the request match the server's admin credentials.
+func (h *handler) checkAdminCredentials(req *http.Request) error {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return params.ErrNoAdminCredsProvided
+	}
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	if h.srv.adminUsername == "" || username != h.srv.adminUsername || password != h.srv.adminPassword {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "invalid credentials")
+	}
+	return nil
 }
 
 type loginRequest struct {
@@ -287,11 +903,24 @@ type visitURLResponse struct {
 // be provided with a test id. /login also supports some additional parameters:
 //     a = if set to "true" an agent URL will be added to the json response.
 //     i = if set to "true" a plaintext response will be sent to simulate interaction.
-func (h *handler) Login(p httprequest.Params, req *loginRequest) (*visitURLResponse, error) {
+//
+// If the discharge request held an agent-login cookie, the login is
+// completed immediately; otherwise the available login methods are
+// returned.
+func (h *handler) Login(p httprequest.Params, req *loginRequest) (interface{}, error) {
 	h.srv.mu.Lock()
 	defer h.srv.mu.Unlock()
+	w, err := h.srv.lookupWait(req.WaitID)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if w.username == "" {
+		return &params.LoginMethods{
+			Agent: fmt.Sprintf("%s/v1/agent-login/%d", h.srv.URL, req.WaitID),
+		}, nil
+	}
 	select {
-	case h.srv.waits[req.WaitID] <- struct{}{}:
+	case w.done <- struct{}{}:
 	default:
 	}
 	return &visitURLResponse{
@@ -299,33 +928,71 @@ func (h *handler) Login(p httprequest.Params, req *loginRequest) (*visitURLRespo
 	}, nil
 }
 
+type agentLoginRequest struct {
+	httprequest.Route `httprequest:"POST /v1/agent-login/:WaitID"`
+	WaitID            int               `httprequest:",path"`
+	AgentLogin        params.AgentLogin `httprequest:",body"`
+}
+
+// AgentLogin logs in as the agent in the request. The agent must
+// exist and the public key must be one of the agent's public keys.
+func (h *handler) AgentLogin(req *agentLoginRequest) (*params.AgentLoginResponse, error) {
+	h.srv.mu.Lock()
+	defer h.srv.mu.Unlock()
+	w, err := h.srv.lookupWait(req.WaitID)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if req.AgentLogin.PublicKey == nil {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "public key not specified")
+	}
+	u := h.srv.users[string(req.AgentLogin.Username)]
+	if u == nil || !u.hasPublicKey(req.AgentLogin.PublicKey) {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "invalid agent credentials for %q", req.AgentLogin.Username)
+	}
+	w.username = string(req.AgentLogin.Username)
+	w.key = req.AgentLogin.PublicKey
+	select {
+	case w.done <- struct{}{}:
+	default:
+	}
+	return &params.AgentLoginResponse{
+		AgentLogin: true,
+	}, nil
+}
+
 type waitRequest struct {
 	httprequest.Route `httprequest:"GET /v1/wait/:WaitID"`
-	WaitID            int               `httprequest:",path"`
-	Username          string            `httprequest:"username,form"`
-	CaveatID          string            `httprequest:"caveat-id,form"`
-	PublicKey         *bakery.PublicKey `httprequest:"pubkey,form"`
+	WaitID            int    `httprequest:",path"`
+	CaveatID          string `httprequest:"caveat-id,form"`
 }
 
 func (h *handler) Wait(req *waitRequest) (*httpbakery.WaitResponse, error) {
 	h.srv.mu.Lock()
-	c := h.srv.waits[req.WaitID]
+	w, err := h.srv.lookupWait(req.WaitID)
+	h.srv.mu.Unlock()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	<-w.done
+	h.srv.mu.Lock()
+	username, key := w.username, w.key
+	u := h.srv.users[username]
+	ok := u != nil && u.hasPublicKey(key)
 	h.srv.mu.Unlock()
-	<-c
-	u := h.srv.user(req.Username)
 	if u == nil {
 		return nil, errgo.Newf("user not found")
 	}
-	if *req.PublicKey != u.key.Public {
+	if !ok {
 		return nil, errgo.Newf("public key mismatch")
 	}
 	checker := func(cavId, cav string) ([]checkers.Caveat, error) {
 		return []checkers.Caveat{
-			checkers.DeclaredCaveat("username", req.Username),
-			bakery.LocalThirdPartyCaveat(&u.key.Public),
+			checkers.DeclaredCaveat("username", username),
+			bakery.LocalThirdPartyCaveat(key),
 		}, nil
 	}
-	m, err := h.srv.bakery.Discharge(bakery.ThirdPartyCheckerFunc(checker), req.CaveatID)
+	m, err := h.srv.service().Discharge(bakery.ThirdPartyCheckerFunc(checker), req.CaveatID)
 	if err != nil {
 		return nil, errgo.NoteMask(err, "cannot discharge", errgo.Any)
 	}
@@ -333,3 +1000,29 @@ func (h *handler) Wait(req *waitRequest) (*httpbakery.WaitResponse, error) {
 		Macaroon: m,
 	}, nil
 }
+
+// hasPublicKey reports whether the given key is one of the user's
+// public keys, and so may be used to log in as an agent.
+func (u *user) hasPublicKey(key *bakery.PublicKey) bool {
+	if key == nil {
+		return false
+	}
+	for _, k := range u.info.PublicKeys {
+		if k != nil && *k == *key {
+			return true
+		}
+	}
+	return false
+}
+
+// clientKey returns the most recently added key pair generated by the
+// server for the user whose public key is still one of the user's
+// public keys, or nil if there is none.
+func (u *user) clientKey() *bakery.KeyPair {
+	for i := len(u.keys) - 1; i >= 0; i-- {
+		if u.hasPublicKey(&u.keys[i].Public) {
+			return u.keys[i]
+		}
+	}
+	return nil
+}
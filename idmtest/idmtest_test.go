@@ -4,8 +4,12 @@
 package idmtest_test
 
 import (
+	"fmt"
+	"time"
+
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v1/bakery"
 	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v1/httpbakery"
@@ -94,3 +98,708 @@ func (*suite) TestGroups(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(groups, gc.HasLen, 0)
 }
+
+func (*suite) TestUser(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", "beatles")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	u, err := client.User(&idmparams.UserRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(u.Username, gc.Equals, idmparams.Username("bob"))
+	c.Assert(u.IDPGroups, jc.DeepEquals, []string{"beatles"})
+	c.Assert(u.PublicKeys, jc.DeepEquals, []*bakery.PublicKey{&srv.UserPublicKey("bob").Public})
+
+	_, err = client.User(&idmparams.UserRequest{
+		Username: "alice",
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?user "alice" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrNotFound)
+}
+
+func (*suite) TestAddUserKey(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", "beatles")
+	key0 := srv.UserPublicKey("bob")
+	key1 := srv.AddUserKey("bob")
+	c.Assert(srv.UserPublicKeys("bob"), jc.DeepEquals, []*bakery.PublicKey{&key0.Public, &key1.Public})
+
+	// The user can log in as an agent with either key.
+	for i, key := range []*bakery.KeyPair{key0, key1} {
+		c.Logf("test %d", i)
+		bclient := httpbakery.NewClient()
+		idmclient.SetUpAgentLogin(bclient, "bob", key)
+		client := idmclient.New(idmclient.NewParams{
+			BaseURL: srv.URL.String(),
+			Client:  bclient,
+		})
+		groups, err := client.UserGroups(&idmparams.UserGroupsRequest{
+			Username: "bob",
+		})
+		c.Assert(err, gc.IsNil)
+		c.Assert(groups, jc.DeepEquals, []string{"beatles"})
+	}
+}
+
+func (*suite) TestSetUser(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", idmtest.AdminGroup)
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	err = client.SetUser(&idmparams.SetUserRequest{
+		Username: "alice",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/alice",
+			FullName:   "Alice Liddell",
+			Email:      "alice@example.com",
+			GravatarID: "0123456789abcdef",
+			IDPGroups:  []string{"beatles"},
+			PublicKeys: []*bakery.PublicKey{&key.Public},
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	u, err := client.User(&idmparams.UserRequest{
+		Username: "alice",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(u, jc.DeepEquals, &idmparams.User{
+		Username:   "alice",
+		ExternalID: "http://example.com/+id/alice",
+		FullName:   "Alice Liddell",
+		Email:      "alice@example.com",
+		GravatarID: "0123456789abcdef",
+		IDPGroups:  []string{"beatles"},
+		PublicKeys: []*bakery.PublicKey{&key.Public},
+	})
+
+	// Updating an existing user leaves the groups alone but
+	// replaces the public keys.
+	err = client.SetUser(&idmparams.SetUserRequest{
+		Username: "alice",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/alice",
+			FullName:   "Alice Pleasance Liddell",
+			IDPGroups:  []string{"other"},
+			PublicKeys: []*bakery.PublicKey{},
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	u, err = client.User(&idmparams.UserRequest{
+		Username: "alice",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(u.FullName, gc.Equals, "Alice Pleasance Liddell")
+	c.Assert(u.IDPGroups, jc.DeepEquals, []string{"beatles"})
+	c.Assert(u.PublicKeys, jc.DeepEquals, []*bakery.PublicKey{})
+}
+
+func (*suite) TestClientAfterSetUser(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", idmtest.AdminGroup)
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	srv.AddUser("alice")
+	key0 := srv.UserPublicKey("alice")
+	key1 := srv.AddUserKey("alice")
+	// The client uses the most recently added key.
+	c.Assert(srv.UserPublicKey("alice"), gc.Equals, key1)
+
+	// When that key is removed, the client falls back to the
+	// remaining one.
+	err := client.SetUser(&idmparams.SetUserRequest{
+		Username: "alice",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/alice",
+			PublicKeys: []*bakery.PublicKey{&key0.Public},
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(srv.UserPublicKey("alice"), gc.Equals, key0)
+	aliceClient := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("alice"),
+	})
+	_, err = aliceClient.UserGroups(&idmparams.UserGroupsRequest{
+		Username: "alice",
+	})
+	c.Assert(err, gc.IsNil)
+
+	// When no key generated by the server remains, the client
+	// cannot be created.
+	key, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	err = client.SetUser(&idmparams.SetUserRequest{
+		Username: "alice",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/alice",
+			PublicKeys: []*bakery.PublicKey{&key.Public},
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(func() {
+		srv.Client("alice")
+	}, gc.PanicMatches, `no server-generated key registered for user "alice"`)
+}
+
+var setUserErrorTests = []struct {
+	about       string
+	req         idmparams.SetUserRequest
+	expectError string
+	expectCause error
+}{{
+	about: "no external id or owner",
+	req: idmparams.SetUserRequest{
+		Username: "alice",
+	},
+	expectError: `(.*: )?external_id or owner must be specified`,
+	expectCause: idmparams.ErrBadRequest,
+}, {
+	about: "both external id and owner",
+	req: idmparams.SetUserRequest{
+		Username: "agent@bob",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/agent",
+			Owner:      "bob",
+		},
+	},
+	expectError: `(.*: )?external_id and owner cannot both be specified`,
+	expectCause: idmparams.ErrBadRequest,
+}, {
+	about: "agent with wrong suffix",
+	req: idmparams.SetUserRequest{
+		Username: "agent@alice",
+		User: idmparams.User{
+			Owner: "bob",
+		},
+	},
+	expectError: `(.*: )?bob cannot create user "agent@alice" \(suffix must be "@bob"\)`,
+	expectCause: idmparams.ErrForbidden,
+}, {
+	about: "duplicate external id",
+	req: idmparams.SetUserRequest{
+		Username: "alice",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/bob",
+		},
+	},
+	expectError: `(.*: )?cannot store identity: external_id "http://example.com/\+id/bob" already in use`,
+	expectCause: idmparams.ErrAlreadyExists,
+}}
+
+func (*suite) TestSetUserErrors(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", idmtest.AdminGroup)
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	err := client.SetUser(&idmparams.SetUserRequest{
+		Username: "bob",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/bob",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	for i, test := range setUserErrorTests {
+		c.Logf("%d. %s", i, test.about)
+		err := client.SetUser(&test.req)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, test.expectCause)
+	}
+}
+
+func (*suite) TestSetUserCannotTakeOverUser(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", idmtest.AdminGroup)
+	srv.AddUser("alice")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	err := client.SetUser(&idmparams.SetUserRequest{
+		Username: "x@alice",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/x",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+
+	// Although the username has alice's suffix, alice does not
+	// own the user, so she cannot overwrite it.
+	aliceClient := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("alice"),
+	})
+	err = aliceClient.SetUser(&idmparams.SetUserRequest{
+		Username: "x@alice",
+		User: idmparams.User{
+			Owner: "alice",
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?no admin credentials provided and user "alice" is not an administrator`)
+	u, err := client.User(&idmparams.UserRequest{
+		Username: "x@alice",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(u.ExternalID, gc.Equals, "http://example.com/+id/x")
+	c.Assert(u.Owner, gc.Equals, idmparams.Username(""))
+
+	// She can still create and then update agents of her own.
+	for i := 0; i < 2; i++ {
+		err = aliceClient.SetUser(&idmparams.SetUserRequest{
+			Username: "agent@alice",
+			User: idmparams.User{
+				Owner:    "alice",
+				FullName: fmt.Sprintf("agent %d", i),
+			},
+		})
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (*suite) TestQueryUsers(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", idmtest.AdminGroup)
+	srv.AddUser("alice")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	err := client.SetUser(&idmparams.SetUserRequest{
+		Username: "charlie",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/charlie",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+
+	users, err := client.QueryUsers(&idmparams.QueryUsersRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(users, jc.DeepEquals, []string{"alice", "bob", "charlie"})
+
+	users, err = client.QueryUsers(&idmparams.QueryUsersRequest{
+		ExternalID: "http://example.com/+id/charlie",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(users, jc.DeepEquals, []string{"charlie"})
+
+	users, err = client.QueryUsers(&idmparams.QueryUsersRequest{
+		ExternalID: "http://example.com/+id/nobody",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(users, gc.HasLen, 0)
+}
+
+func (*suite) TestExtraInfo(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", idmtest.AdminGroup)
+	srv.SetUserExtraInfo("bob", map[string]interface{}{
+		"colour": "blue",
+	})
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	info, err := client.UserExtraInfo(&idmparams.UserExtraInfoRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, jc.DeepEquals, map[string]interface{}{
+		"colour": "blue",
+	})
+
+	err = client.SetUserExtraInfo(&idmparams.SetUserExtraInfoRequest{
+		Username: "bob",
+		ExtraInfo: map[string]interface{}{
+			"size":   "large",
+			"shapes": []interface{}{"square", "circle"},
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(srv.UserExtraInfo("bob"), jc.DeepEquals, map[string]interface{}{
+		"colour": "blue",
+		"size":   "large",
+		"shapes": []interface{}{"square", "circle"},
+	})
+
+	err = client.SetUserExtraInfoItem(&idmparams.SetUserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "colour",
+		Data:     map[string]interface{}{"r": 0.0, "g": 0.0, "b": 255.0},
+	})
+	c.Assert(err, gc.IsNil)
+	item, err := client.UserExtraInfoItem(&idmparams.UserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "colour",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, jc.DeepEquals, map[string]interface{}{"r": 0.0, "g": 0.0, "b": 255.0})
+}
+
+func (*suite) TestExtraInfoErrors(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", idmtest.AdminGroup)
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	_, err := client.UserExtraInfo(&idmparams.UserExtraInfoRequest{
+		Username: "alice",
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?user "alice" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrNotFound)
+
+	_, err = client.UserExtraInfoItem(&idmparams.UserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "colour",
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?item "colour" not found for user "bob"`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrNotFound)
+
+	err = client.SetUserExtraInfoItem(&idmparams.SetUserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "a$b",
+		Data:     1,
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?"a\$b" bad key for extra-info`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrBadRequest)
+
+	err = client.SetUserExtraInfo(&idmparams.SetUserExtraInfoRequest{
+		Username: "bob",
+		ExtraInfo: map[string]interface{}{
+			"good":    1,
+			"bad.key": 2,
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?"bad.key" bad key for extra-info`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrBadRequest)
+	c.Assert(srv.UserExtraInfo("bob"), gc.HasLen, 0)
+}
+
+func (*suite) TestUserToken(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("alice", idmtest.AdminGroup)
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("alice"),
+	})
+	m, err := client.UserToken(&idmparams.UserTokenRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	attrs, err := client.VerifyToken(&idmparams.VerifyTokenRequest{
+		Macaroons: macaroon.Slice{m},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(attrs, jc.DeepEquals, map[string]string{
+		"username": "bob",
+	})
+
+	_, err = client.UserToken(&idmparams.UserTokenRequest{
+		Username: "charlie",
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?user "charlie" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrNotFound)
+}
+
+func (*suite) TestUserTokenNotAdmin(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	_, err := client.UserToken(&idmparams.UserTokenRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?no admin credentials provided and user "bob" is not an administrator`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrNoAdminCredsProvided)
+}
+
+func (*suite) TestVerifyTokenFailures(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("alice", idmtest.AdminGroup)
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("alice"),
+	})
+	m, err := client.UserToken(&idmparams.UserTokenRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+
+	// An expired token is rejected.
+	expired := m.Clone()
+	err = expired.AddFirstPartyCaveat(checkers.TimeBeforeCaveat(time.Now().Add(-time.Minute)).Condition)
+	c.Assert(err, gc.IsNil)
+	_, err = client.VerifyToken(&idmparams.VerifyTokenRequest{
+		Macaroons: macaroon.Slice{expired},
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?verification failure: .*`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrForbidden)
+
+	// A token that was not minted by the server is rejected.
+	forged, err := macaroon.New([]byte("not the root key"), m.Id(), m.Location())
+	c.Assert(err, gc.IsNil)
+	err = forged.AddFirstPartyCaveat(checkers.DeclaredCaveat("username", "alice").Condition)
+	c.Assert(err, gc.IsNil)
+	_, err = client.VerifyToken(&idmparams.VerifyTokenRequest{
+		Macaroons: macaroon.Slice{forged},
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?verification failure: .*`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrForbidden)
+}
+
+func (*suite) TestPublicKey(c *gc.C) {
+	srv := idmtest.NewServer()
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  httpbakery.NewClient(),
+	})
+	resp, err := client.PublicKey(&idmparams.PublicKeyRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.PublicKey, jc.DeepEquals, srv.PublicKey)
+
+	oldKey := srv.PublicKey
+	newKey := srv.RotateKey()
+	c.Assert(newKey, gc.Not(jc.DeepEquals), oldKey)
+	c.Assert(srv.PublicKey, jc.DeepEquals, newKey)
+	resp, err = client.PublicKey(&idmparams.PublicKeyRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.PublicKey, jc.DeepEquals, newKey)
+}
+
+func (*suite) TestRotateKeyDischarge(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob")
+	client := srv.Client("bob")
+	bsvc, err := bakery.NewService(bakery.NewServiceParams{
+		Locator: srv,
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := bsvc.NewMacaroon("", nil, []checkers.Caveat{{
+		Location:  srv.URL.String() + "/v1/discharger",
+		Condition: "is-authenticated-user",
+	}})
+	c.Assert(err, gc.IsNil)
+
+	// The caveat was encrypted with the old key, so
+	// it can no longer be discharged.
+	srv.RotateKey()
+	_, err = client.DischargeAll(m)
+	c.Assert(err, gc.ErrorMatches, `.*cannot get discharge.*`)
+
+	// A macaroon minted after the rotation can be discharged.
+	m, err = bsvc.NewMacaroon("", nil, []checkers.Caveat{{
+		Location:  srv.URL.String() + "/v1/discharger",
+		Condition: "is-authenticated-user",
+	}})
+	c.Assert(err, gc.IsNil)
+	ms, err := client.DischargeAll(m)
+	c.Assert(err, gc.IsNil)
+	attrs, err := bsvc.CheckAny([]macaroon.Slice{ms}, nil, checkers.New())
+	c.Assert(err, gc.IsNil)
+	c.Assert(attrs, jc.DeepEquals, map[string]string{
+		"username": "bob",
+	})
+}
+
+func (*suite) TestAdminCredentials(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.SetAdminCredentials("admin", "password")
+	srv.AddUser("bob", "beatles")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL:      srv.URL.String(),
+		Client:       httpbakery.NewClient(),
+		AuthUsername: "admin",
+		AuthPassword: "password",
+	})
+
+	// Admin-only endpoints can be used.
+	err := client.SetUser(&idmparams.SetUserRequest{
+		Username: "alice",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/alice",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	err = client.SetUserExtraInfoItem(&idmparams.SetUserExtraInfoItemRequest{
+		Username: "alice",
+		Item:     "colour",
+		Data:     "red",
+	})
+	c.Assert(err, gc.IsNil)
+	_, err = client.UserToken(&idmparams.UserTokenRequest{
+		Username: "alice",
+	})
+	c.Assert(err, gc.IsNil)
+
+	// Regular endpoints can be used too.
+	groups, err := client.UserGroups(&idmparams.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(groups, jc.DeepEquals, []string{"beatles"})
+}
+
+func (*suite) TestBadAdminCredentials(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.SetAdminCredentials("admin", "password")
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL:      srv.URL.String(),
+		Client:       httpbakery.NewClient(),
+		AuthUsername: "admin",
+		AuthPassword: "wrong",
+	})
+	err := client.SetUserExtraInfoItem(&idmparams.SetUserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "colour",
+		Data:     "red",
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?invalid credentials`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrUnauthorized)
+
+	// Bad credentials are not accepted in place of a macaroon.
+	_, err = client.UserGroups(&idmparams.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?invalid credentials`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrUnauthorized)
+}
+
+func (*suite) TestAdminEndpointsWithoutCredentials(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.SetAdminCredentials("admin", "password")
+	srv.AddUser("bob")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	err := client.SetUserExtraInfoItem(&idmparams.SetUserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "colour",
+		Data:     "red",
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?no admin credentials provided and user "bob" is not an administrator`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrNoAdminCredsProvided)
+
+	err = client.SetUser(&idmparams.SetUserRequest{
+		Username: "alice",
+		User: idmparams.User{
+			ExternalID: "http://example.com/+id/alice",
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `(.*: )?no admin credentials provided and user "bob" is not an administrator`)
+	c.Assert(errgo.Cause(err), gc.Equals, idmparams.ErrNoAdminCredsProvided)
+
+	// A user may create their own agents.
+	err = client.SetUser(&idmparams.SetUserRequest{
+		Username: "agent@bob",
+		User: idmparams.User{
+			Owner: "bob",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+func (*suite) TestUserChanges(c *gc.C) {
+	srv := idmtest.NewServer()
+	srv.AddUser("bob", idmtest.AdminGroup)
+	srv.AddUser("alice")
+	client := idmclient.New(idmclient.NewParams{
+		BaseURL: srv.URL.String(),
+		Client:  srv.Client("bob"),
+	})
+	err := client.SetUserExtraInfoItem(&idmparams.SetUserExtraInfoItemRequest{
+		Username: "alice",
+		Item:     "color",
+		Data:     "blue",
+	})
+	c.Assert(err, gc.IsNil)
+
+	resp, err := client.UserChanges(&idmparams.UserChangesRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp, jc.DeepEquals, &idmparams.UserChangesResponse{
+		Changes: []idmparams.UserChange{{
+			Seq:      1,
+			Username: "bob",
+		}, {
+			Seq:      2,
+			Username: "alice",
+		}, {
+			Seq:      3,
+			Username: "alice",
+		}},
+		Latest: 3,
+	})
+
+	// Only the latest sequence number is returned when asked for,
+	// without waiting.
+	resp, err = client.UserChanges(&idmparams.UserChangesRequest{
+		Timeout:    5000,
+		LatestOnly: true,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp, jc.DeepEquals, &idmparams.UserChangesResponse{
+		Changes: []idmparams.UserChange{},
+		Latest:  3,
+	})
+
+	// With no new changes, the request times out.
+	resp, err = client.UserChanges(&idmparams.UserChangesRequest{
+		Since:   3,
+		Timeout: 10,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp, jc.DeepEquals, &idmparams.UserChangesResponse{
+		Changes: []idmparams.UserChange{},
+		Latest:  3,
+	})
+
+	// A waiting request returns when a change is made.
+	done := make(chan *idmparams.UserChangesResponse)
+	go func() {
+		resp, err := client.UserChanges(&idmparams.UserChangesRequest{
+			Since:   3,
+			Timeout: 5000,
+		})
+		c.Check(err, gc.IsNil)
+		done <- resp
+	}()
+	time.Sleep(20 * time.Millisecond)
+	srv.AddUser("charlie")
+	select {
+	case resp := <-done:
+		c.Assert(resp, jc.DeepEquals, &idmparams.UserChangesResponse{
+			Changes: []idmparams.UserChange{{
+				Seq:      4,
+				Username: "charlie",
+			}},
+			Latest: 4,
+		})
+	case <-time.After(5 * time.Second):
+		c.Fatalf("change not received")
+	}
+
+	// A point the server does not know about is reported as truncated.
+	resp, err = client.UserChanges(&idmparams.UserChangesRequest{
+		Since: 10,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.Truncated, gc.Equals, true)
+	c.Assert(resp.Changes, gc.HasLen, 4)
+	c.Assert(resp.Latest, gc.Equals, uint64(4))
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package params
+
+import (
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Everyone is the ACL term that matches all users.
+const Everyone = "everyone"
+
+// ACL holds a parsed access control list. A user is allowed by an ACL
+// if they match at least one of its allow entries and none of its deny
+// entries, so deny entries take precedence regardless of where they
+// appear. An empty ACL allows nobody.
+//
+// The textual form of an ACL has the following grammar:
+//
+//	acl   = [ entry { "," entry } ]
+//	entry = [ "!" ] term { "AND" term }
+//	term  = "everyone" | "*@" domain | name
+//
+// Terms within an entry are separated by white space. An entry beginning
+// with "!" is a deny entry. An entry matches a user when all of its terms
+// match. The "everyone" term matches all users; a "*@domain" term
+// matches any user whose name ends with "@domain"; any other term
+// matches the user with that name or any member of the group with that
+// name. For example:
+//
+//	admin, dev AND staff@example, !*@external
+//
+// allows members of the admin group and users in both the dev and
+// staff@example groups, except for users in the external domain.
+type ACL []ACLEntry
+
+// ACLEntry holds a single entry in an ACL.
+type ACLEntry struct {
+	// Deny holds whether the entry denies access rather
+	// than allowing it.
+	Deny bool
+
+	// Terms holds the terms of the entry, all of which
+	// must match for the entry to match.
+	Terms []string
+}
+
+// ParseACL parses the textual form of an ACL,
+// as described in the documentation for ACL.
+func ParseACL(s string) (ACL, error) {
+	if strings.TrimSpace(s) == "" {
+		return ACL{}, nil
+	}
+	parts := strings.Split(s, ",")
+	acl := make(ACL, len(parts))
+	for i, part := range parts {
+		e, err := parseACLEntry(part)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid ACL %q", s)
+		}
+		acl[i] = e
+	}
+	return acl, nil
+}
+
+func parseACLEntry(s string) (ACLEntry, error) {
+	var e ACLEntry
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "!") {
+		e.Deny = true
+		s = s[1:]
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ACLEntry{}, errgo.New("empty entry")
+	}
+	for i, f := range fields {
+		if i%2 == 1 {
+			if f != "AND" {
+				return ACLEntry{}, errgo.Newf("expected AND, found %q", f)
+			}
+			continue
+		}
+		if err := checkACLTerm(f); err != nil {
+			return ACLEntry{}, errgo.Mask(err)
+		}
+		e.Terms = append(e.Terms, f)
+	}
+	if len(fields)%2 == 0 {
+		return ACLEntry{}, errgo.New("missing term after AND")
+	}
+	return e, nil
+}
+
+func checkACLTerm(t string) error {
+	switch {
+	case t == "AND":
+		return errgo.New("unexpected AND")
+	case strings.HasPrefix(t, "*@"):
+		if len(t) == 2 || strings.ContainsAny(t[2:], "*!") {
+			return errgo.Newf("invalid wildcard %q", t)
+		}
+	case strings.ContainsAny(t, "*!"):
+		return errgo.Newf("invalid term %q", t)
+	}
+	return nil
+}
+
+// String returns the textual form of the ACL.
+func (acl ACL) String() string {
+	entries := make([]string, len(acl))
+	for i, e := range acl {
+		entries[i] = e.String()
+	}
+	return strings.Join(entries, ", ")
+}
+
+// String returns the textual form of the entry.
+func (e ACLEntry) String() string {
+	s := strings.Join(e.Terms, " AND ")
+	if e.Deny {
+		s = "!" + s
+	}
+	return s
+}
+
+// MarshalText implements encoding.TextMarshaler
+// by returning the textual form of the ACL.
+func (acl ACL) MarshalText() ([]byte, error) {
+	return []byte(acl.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+// by parsing the textual form of an ACL.
+func (acl *ACL) UnmarshalText(b []byte) error {
+	a, err := ParseACL(string(b))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	*acl = a
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package params_test
+
+import (
+	"encoding/json"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/identity/params"
+)
+
+type aclSuite struct{}
+
+var _ = gc.Suite(&aclSuite{})
+
+var parseACLTests = []struct {
+	about       string
+	acl         string
+	expect      params.ACL
+	expectError string
+}{{
+	about:  "empty",
+	acl:    "",
+	expect: params.ACL{},
+}, {
+	about: "simple names",
+	acl:   "everyone, bob,admin@idm",
+	expect: params.ACL{{
+		Terms: []string{"everyone"},
+	}, {
+		Terms: []string{"bob"},
+	}, {
+		Terms: []string{"admin@idm"},
+	}},
+}, {
+	about: "deny and intersection",
+	acl:   "dev AND staff, !*@external, ! bob",
+	expect: params.ACL{{
+		Terms: []string{"dev", "staff"},
+	}, {
+		Deny:  true,
+		Terms: []string{"*@external"},
+	}, {
+		Deny:  true,
+		Terms: []string{"bob"},
+	}},
+}, {
+	about:       "empty entry",
+	acl:         "bob,,alice",
+	expectError: `invalid ACL "bob,,alice": empty entry`,
+}, {
+	about:       "missing AND",
+	acl:         "dev staff",
+	expectError: `invalid ACL "dev staff": expected AND, found "staff"`,
+}, {
+	about:       "trailing AND",
+	acl:         "dev AND",
+	expectError: `invalid ACL "dev AND": missing term after AND`,
+}, {
+	about:       "leading AND",
+	acl:         "AND dev",
+	expectError: `invalid ACL "AND dev": unexpected AND`,
+}, {
+	about:       "empty wildcard domain",
+	acl:         "*@",
+	expectError: `invalid ACL "\*@": invalid wildcard "\*@"`,
+}, {
+	about:       "bad wildcard",
+	acl:         "bob*",
+	expectError: `invalid ACL "bob\*": invalid term "bob\*"`,
+}}
+
+func (s *aclSuite) TestParseACL(c *gc.C) {
+	for i, test := range parseACLTests {
+		c.Logf("%d. %s", i, test.about)
+		acl, err := params.ParseACL(test.acl)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(acl, jc.DeepEquals, test.expect)
+
+		// Check that the ACL round-trips through its textual form.
+		acl1, err := params.ParseACL(acl.String())
+		c.Assert(err, gc.IsNil)
+		c.Assert(acl1, jc.DeepEquals, acl)
+	}
+}
+
+func (s *aclSuite) TestACLString(c *gc.C) {
+	acl := params.ACL{{
+		Terms: []string{"dev", "staff"},
+	}, {
+		Deny:  true,
+		Terms: []string{"*@external"},
+	}}
+	c.Assert(acl.String(), gc.Equals, "dev AND staff, !*@external")
+}
+
+func (s *aclSuite) TestACLJSON(c *gc.C) {
+	var v struct {
+		ACL params.ACL `json:"acl"`
+	}
+	err := json.Unmarshal([]byte(`{"acl": "admin, !*@external"}`), &v)
+	c.Assert(err, gc.IsNil)
+	c.Assert(v.ACL, jc.DeepEquals, params.ACL{{
+		Terms: []string{"admin"},
+	}, {
+		Deny:  true,
+		Terms: []string{"*@external"},
+	}})
+	data, err := json.Marshal(v)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"acl":"admin, !*@external"}`)
+
+	err = json.Unmarshal([]byte(`{"acl": "admin AND"}`), &v)
+	c.Assert(err, gc.ErrorMatches, `invalid ACL "admin AND": missing term after AND`)
+}
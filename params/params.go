@@ -10,6 +10,7 @@ import (
 	"github.com/juju/httprequest"
 	"github.com/juju/names"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/environschema.v1"
 	"gopkg.in/macaroon-bakery.v1/bakery"
 	"gopkg.in/macaroon.v1"
 )
@@ -75,11 +76,27 @@ type LoginMethods struct {
 
 	// Form is the endpoint to GET a schema for a login form which
 	// can be presented to the user in an interactive manner. The
-	// schema will be returned as an environschema.Fields object. The
-	// completed form should be POSTed back to the same endpoint.
+	// schema will be returned as an environschema.Fields object
+	// inside a SchemaResponse. The completed form should be POSTed
+	// back to the same endpoint as a LoginBody.
 	Form string `json:"form,omitempty"`
 }
 
+// SchemaResponse holds the response from a GET request to the Form
+// login endpoint.
+type SchemaResponse struct {
+	// Schema holds the schema of the login form.
+	Schema environschema.Fields `json:"schema"`
+}
+
+// LoginBody holds the body of a completed login form
+// POSTed to the Form login endpoint.
+type LoginBody struct {
+	// Form holds the values of the completed form,
+	// keyed by field name.
+	Form map[string]interface{} `json:"form"`
+}
+
 // QueryUsersRequest is a request to query the users in the system.
 type QueryUsersRequest struct {
 	httprequest.Route `httprequest:"GET /v1/u" bson:",omitempty"`
@@ -169,3 +186,41 @@ type SetUserExtraInfoItemRequest struct {
 	Item              string      `httprequest:"item,path"`
 	Data              interface{} `httprequest:",body"`
 }
+
+// UserChangesRequest is a request for the changes made to users after
+// a given point. If no changes have been made after that point, the
+// server waits for up to Timeout milliseconds for one to be made before
+// responding. If LatestOnly is true, the server responds immediately
+// with no changes, so that only the sequence number of the most recent
+// change is returned.
+type UserChangesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/changes"`
+	Since             uint64 `httprequest:"since,form"`
+	Timeout           int    `httprequest:"timeout,form"`
+	LatestOnly        bool   `httprequest:"latest_only,form"`
+}
+
+// UserChangesResponse holds the response to a UserChangesRequest.
+type UserChangesResponse struct {
+	// Changes holds the changes made after the requested point,
+	// in order.
+	Changes []UserChange `json:"changes"`
+
+	// Latest holds the sequence number of the most recent change,
+	// suitable for use as Since in a subsequent request.
+	Latest uint64 `json:"latest"`
+
+	// Truncated reports that some changes made after the requested
+	// point are no longer known to the server, so any user may have
+	// changed.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// UserChange records a change to a user.
+type UserChange struct {
+	// Seq holds the sequence number of the change.
+	Seq uint64 `json:"seq"`
+
+	// Username holds the name of the user that changed.
+	Username Username `json:"username"`
+}